@@ -12,12 +12,16 @@ import (
 
 	"code.cloudfoundry.org/lager"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/vshn/crossplane-service-broker/pkg/api"
 	"github.com/vshn/crossplane-service-broker/pkg/api/auth"
 	"github.com/vshn/crossplane-service-broker/pkg/brokerapi"
 	"github.com/vshn/crossplane-service-broker/pkg/config"
 	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
 	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/vshn/swisscom-service-broker/pkg/custom"
 )
@@ -64,14 +68,49 @@ func run(signalChan chan os.Signal, logger lager.Logger) error {
 		return err
 	}
 
-	customAPIHandler := custom.NewAPIHandler(cp, logger.WithData(lager.Data{"component": "custom"}))
-	custom.NewAPI(router.NewRoute().Subrouter(), customAPIHandler, cfg.Username, cfg.Password, logger)
+	customCfg, err := custom.ReadConfig(os.Getenv)
+	if err != nil {
+		return fmt.Errorf("unable to read custom API config: %w", err)
+	}
+	customCfg.Namespace = cfg.Namespace
+	customCfg.PlanUpdateSizeRule = cfg.PlanUpdateSizeRule
+	customCfg.PlanUpdateSLARule = cfg.PlanUpdateSLARule
+	k8sClient, err := client.New(rConfig, client.Options{})
+	if err != nil {
+		return fmt.Errorf("unable to create k8s client: %w", err)
+	}
+	cacheOpts, err := custom.CacheOptions(cfg.Namespace)
+	if err != nil {
+		return fmt.Errorf("unable to create instance cache: %w", err)
+	}
+	instanceCache, err := cache.New(rConfig, cacheOpts)
+	if err != nil {
+		return fmt.Errorf("unable to create instance cache: %w", err)
+	}
+	cacheCtx, stopCache := context.WithCancel(context.Background())
+	defer stopCache()
+	if err := custom.RecordJobResults(cacheCtx, instanceCache, k8sClient, logger.WithData(lager.Data{"component": "job-results"})); err != nil {
+		return fmt.Errorf("unable to watch job pods: %w", err)
+	}
+	go func() {
+		if err := instanceCache.Start(cacheCtx); err != nil {
+			logger.Error("instance cache error", err)
+			signalChan <- syscall.SIGABRT
+		}
+	}()
+
+	if customCfg.BackupsEnabled() {
+		go custom.NewBackupPruner(k8sClient, logger.WithData(lager.Data{"component": "backup-pruner"})).Run(cacheCtx, custom.BackupPruneInterval)
+	}
 
 	pc, err := crossplane.ParsePlanUpdateRules(cfg.PlanUpdateSizeRule, cfg.PlanUpdateSLARule)
 	if err != nil {
 		return err
 	}
-	b := brokerapi.New(cp, logger.WithData(lager.Data{"component": "brokerapi"}), pc)
+	b := custom.NewBroker(brokerapi.New(cp, logger.WithData(lager.Data{"component": "brokerapi"}), pc), k8sClient, logger.WithData(lager.Data{"component": "broker"}))
+
+	customAPIHandler := custom.NewAPIHandler(cp, k8sClient, instanceCache, customCfg, logger.WithData(lager.Data{"component": "custom"}))
+	custom.NewAPI(router.NewRoute().Subrouter(), customAPIHandler, customCfg.Credentials(cfg.Username, cfg.Password), customCfg.Tokens(cfg.JWKeyRegister), logger)
 
 	serviceBrokerCredential := auth.SingleCredential(cfg.Username, cfg.Password)
 	a := api.New(b, serviceBrokerCredential, cfg.JWKeyRegister, logger.WithData(lager.Data{"component": "api"}))
@@ -94,6 +133,24 @@ func run(signalChan chan os.Signal, logger lager.Logger) error {
 		logger.Info("server shut down")
 	}()
 
+	metricsRouter := mux.NewRouter()
+	metricsRouter.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	metricsSrv := http.Server{
+		Addr:           customCfg.MetricsListenAddr,
+		Handler:        metricsRouter,
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+
+	go func() {
+		logger.Info("metrics server start", lager.Data{"addr": metricsSrv.Addr})
+		if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server error", err)
+			signalChan <- syscall.SIGABRT
+		}
+	}()
+
 	sig := <-signalChan
 	if sig == syscall.SIGABRT {
 		return errors.New("unable to start server")
@@ -103,5 +160,8 @@ func run(signalChan chan os.Signal, logger lager.Logger) error {
 
 	graceCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if err := metricsSrv.Shutdown(graceCtx); err != nil {
+		logger.Error("metrics server shutdown", err)
+	}
 	return srv.Shutdown(graceCtx)
 }
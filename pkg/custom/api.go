@@ -2,14 +2,21 @@ package custom
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/gorilla/mux"
-	"github.com/pivotal-cf/brokerapi/v8/auth"
 	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
 	"github.com/pivotal-cf/brokerapi/v8/middlewares"
 	"github.com/vshn/crossplane-service-broker/pkg/api"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
 	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
 )
 
@@ -20,7 +27,8 @@ type API struct {
 }
 
 // NewAPI registers the routes and middlewares.
-func NewAPI(router *mux.Router, handler APISpec, username, password string, logger lager.Logger) *API {
+// Requests are authenticated with the given credentials or bearer tokens, each route requires a minimum role.
+func NewAPI(router *mux.Router, handler APISpec, credentials []Credential, tokens *Tokens, logger lager.Logger) *API {
 	a := API{
 		handler: handler,
 		logger:  logger,
@@ -28,10 +36,8 @@ func NewAPI(router *mux.Router, handler APISpec, username, password string, logg
 
 	attachRoutes(router, a)
 
-	authMiddleware := auth.NewWrapper(username, password).Wrap
-
 	router.Use(middlewares.AddCorrelationIDToContext)
-	router.Use(authMiddleware)
+	router.Use(newAuthenticator(credentials, tokens).Wrap)
 	router.Use(middlewares.AddOriginatingIdentityToContext)
 	router.Use(middlewares.AddInfoLocationToContext)
 	router.Use(api.LoggerMiddleware(logger))
@@ -39,18 +45,166 @@ func NewAPI(router *mux.Router, handler APISpec, username, password string, logg
 	return &a
 }
 
+// route is a route of the custom API, which can be called with the role or any role above it.
+// The operations are the methods of APISpec called by the handler, the OpenAPI document is generated from them.
+type route struct {
+	method     string
+	path       string
+	role       Role
+	handler    func(API, http.ResponseWriter, *http.Request)
+	operations []string
+	summary    string
+	status     int
+	query      []queryParameter
+	// optionalBody is set if the request body may be left out
+	optionalBody bool
+	// services the route applies to, all services if empty
+	services []crossplane.ServiceName
+}
+
+// queryParameter is an optional query parameter of a route.
+type queryParameter struct {
+	name        string
+	description string
+	schema      *OpenAPISchema
+}
+
+// backupServices are the services supporting backups and restores.
+var backupServices = []crossplane.ServiceName{crossplane.RedisService, crossplane.MariaDBService, crossplane.MariaDBDatabaseService}
+
+// usageServices are the services reporting their usage.
+var usageServices = []crossplane.ServiceName{crossplane.RedisService, crossplane.MariaDBService, crossplane.MariaDBDatabaseService}
+
+var routes = []route{
+	{
+		method: http.MethodGet, path: "/custom/service_instances/{service_instance_id}/endpoint", role: RoleReadOnly,
+		handler: API.Endpoints, operations: []string{"Endpoints", "NodeEndpoints"}, status: http.StatusOK,
+		summary: "List the endpoints of a service instance, or every node of a Galera cluster if nodes is set",
+		query: []queryParameter{
+			{name: "nodes", description: "List the nodes of a Galera cluster with their role", schema: &OpenAPISchema{Type: "boolean"}},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/custom/service_instances/{service_instance_id}/usage", role: RoleReadOnly,
+		handler: API.ServiceUsage, operations: []string{"ServiceUsage", "ServiceUsageHistory"}, status: http.StatusOK, services: usageServices,
+		summary: "Return the current usage of a service instance, or the usage over a time range if from is given",
+		query: []queryParameter{
+			{name: "from", description: "Start of the time range", schema: &OpenAPISchema{Type: "string", Format: "date-time"}},
+			{name: "to", description: "End of the time range, defaults to now", schema: &OpenAPISchema{Type: "string", Format: "date-time"}},
+			{name: "step", description: "Resolution of the samples as duration, such as 5m", schema: &OpenAPISchema{Type: "string"}},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/custom/admin/service-definition", role: RoleAdmin,
+		handler: API.CreateUpdateServiceDefinition, operations: []string{"CreateUpdateServiceDefinition"}, status: http.StatusNoContent,
+		summary: "Create or update a service and its plans",
+		query: []queryParameter{
+			{name: "dry_run", description: "Only validate the definition", schema: &OpenAPISchema{Type: "boolean"}},
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/custom/admin/service-definition/{id}", role: RoleAdmin,
+		handler: API.DeleteServiceDefinition, operations: []string{"DeleteServiceDefinition"}, status: http.StatusNoContent,
+		summary: "Remove a service or a plan which isn't used by any instance",
+	},
+	{
+		method: http.MethodGet, path: "/custom/admin/service-definition/{id}/revisions", role: RoleAdmin,
+		handler: API.ServiceDefinitionRevisions, operations: []string{"ServiceDefinitionRevisions"}, status: http.StatusOK,
+		summary: "List the revisions of a service definition",
+	},
+	{
+		method: http.MethodPost, path: "/custom/admin/service-definition/{id}/revisions/{revision}/rollback", role: RoleAdmin,
+		handler: API.RollbackServiceDefinition, operations: []string{"RollbackServiceDefinition"}, status: http.StatusOK,
+		summary: "Roll a service definition back to a previous revision",
+	},
+	{
+		method: http.MethodPost, path: "/custom/service_instances/{service_instance_id}/backups", role: RolePlatform,
+		handler: API.CreateBackup, operations: []string{"CreateBackup"}, status: http.StatusCreated, services: backupServices,
+		summary: "Start a backup of a service instance", optionalBody: true,
+	},
+	{
+		method: http.MethodDelete, path: "/custom/service_instances/{service_instance_id}/backups/{backup_id}", role: RolePlatform,
+		handler: API.DeleteBackup, operations: []string{"DeleteBackup"}, status: http.StatusAccepted, services: backupServices,
+		summary: "Delete a backup of a service instance",
+	},
+	{
+		method: http.MethodGet, path: "/custom/service_instances/{service_instance_id}/backups/{backup_id}", role: RoleReadOnly,
+		handler: API.Backup, operations: []string{"Backup"}, status: http.StatusOK, services: backupServices,
+		summary: "Return a backup of a service instance",
+	},
+	{
+		method: http.MethodGet, path: "/custom/service_instances/{service_instance_id}/backups", role: RoleReadOnly,
+		handler: API.ListBackups, operations: []string{"ListBackups"}, status: http.StatusOK, services: backupServices,
+		summary: "List the backups of a service instance",
+	},
+	{
+		method: http.MethodGet, path: "/custom/service_instances/{service_instance_id}/backup-schedule", role: RoleReadOnly,
+		handler: API.BackupSchedule, operations: []string{"BackupSchedule"}, status: http.StatusOK, services: backupServices,
+		summary: "Return the backup schedule of a service instance",
+	},
+	{
+		method: http.MethodPut, path: "/custom/service_instances/{service_instance_id}/backup-schedule", role: RolePlatform,
+		handler: API.SetBackupSchedule, operations: []string{"SetBackupSchedule"}, status: http.StatusOK, services: backupServices,
+		summary: "Set the backup schedule of a service instance, an empty schedule disables scheduled backups",
+	},
+	{
+		method: http.MethodPost, path: "/custom/service_instances/{service_instance_id}/backups/{backup_id}/restores", role: RolePlatform,
+		handler: API.RestoreBackup, operations: []string{"RestoreBackup"}, status: http.StatusAccepted, services: backupServices,
+		summary: "Start restoring a backup", optionalBody: true,
+	},
+	{
+		method: http.MethodGet, path: "/custom/service_instances/{service_instance_id}/backups/{backup_id}/restores/{restore_id}", role: RoleReadOnly,
+		handler: API.RestoreStatus, operations: []string{"RestoreStatus"}, status: http.StatusOK, services: backupServices,
+		summary: "Return the status of a restore",
+	},
+	{
+		method: http.MethodGet, path: "/custom/api-docs", role: RoleReadOnly,
+		handler: API.APIDocs, operations: []string{"APIDocs"}, status: http.StatusOK,
+		summary: "Return the OpenAPI document of the whole custom API",
+	},
+	{
+		method: http.MethodGet, path: "/custom/service_instances/{service_instance_id}/api-docs", role: RoleReadOnly,
+		handler: API.InstanceAPIDocs, operations: []string{"InstanceAPIDocs"}, status: http.StatusOK,
+		summary: "Return the OpenAPI document of the custom API for the service of the instance",
+	},
+}
+
+// instanceRoutes returns the routes operating on instances of the given service.
+func instanceRoutes(service crossplane.ServiceName) []route {
+	var rs []route
+	for _, r := range routes {
+		if !strings.Contains(r.path, "{service_instance_id}") {
+			continue
+		}
+		if len(r.services) > 0 && !containsService(r.services, service) {
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func containsService(services []crossplane.ServiceName, service crossplane.ServiceName) bool {
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
 func attachRoutes(router *mux.Router, api API) {
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/endpoint", api.Endpoints).Methods("GET")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/usage", api.ServiceUsage).Methods("GET")
-	router.HandleFunc("/custom/admin/service-definition", api.CreateUpdateServiceDefinition).Methods("POST")
-	router.HandleFunc("/custom/admin/service-definition/{id}", api.DeleteServiceDefinition).Methods("DELETE")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/backups", api.CreateBackup).Methods("POST")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/backups/{backup_id}", api.DeleteBackup).Methods("DELETE")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/backups/{backup_id}", api.Backup).Methods("GET")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/backups", api.ListBackups).Methods("GET")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/backups/{backup_id}/restores", api.RestoreBackup).Methods("POST")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/backups/{backup_id}/restores/{restore_id}", api.Endpoints).Methods("GET")
-	router.HandleFunc("/custom/service_instances/{service_instance_id}/api-docs", api.APIDocs).Methods("GET")
+	for _, r := range routes {
+		handler, role := r.handler, r.role
+		router.HandleFunc(r.path, func(w http.ResponseWriter, req *http.Request) {
+			if requestRole(req.Context()) < role {
+				rctx := reqcontext.NewReqContext(req.Context(), api.logger, lager.Data{"required-role": role.String()})
+				api.handleAPIError(rctx, w, errInsufficientRole)
+				return
+			}
+			handler(api, w, req)
+		}).Methods(r.method)
+	}
 }
 
 func (a API) respond(w http.ResponseWriter, status int, response interface{}) {
@@ -69,6 +223,17 @@ func (a API) respond(w http.ResponseWriter, status int, response interface{}) {
 
 func (a API) handleAPIError(rctx *reqcontext.ReqContext, w http.ResponseWriter, err error) {
 	switch err := err.(type) {
+	case *validationError:
+		rctx.Logger.Error("validation-failed", err)
+		a.respond(w, http.StatusUnprocessableEntity, ValidationErrorResponse{
+			Error:       "InvalidServiceDefinition",
+			Description: "service definition is invalid",
+			Violations:  err.violations,
+		})
+	case *retryError:
+		rctx.Logger.Error(err.LoggerAction(), err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(err.retryAfter.Seconds())))
+		a.respond(w, err.ValidatedStatusCode(a.logger), err.ErrorResponse())
 	case *apiresponses.FailureResponse:
 		rctx.Logger.Error(err.LoggerAction(), err)
 		a.respond(w, err.ValidatedStatusCode(a.logger), err.ErrorResponse())
@@ -89,7 +254,21 @@ func (a API) Endpoints(w http.ResponseWriter, req *http.Request) {
 	})
 	rctx.Logger.Info("endpoints")
 
-	r, err := a.handler.Endpoints(rctx, instanceID)
+	nodes := false
+	if n := req.URL.Query().Get("nodes"); n != "" {
+		var err error
+		nodes, err = strconv.ParseBool(n)
+		if err != nil {
+			a.handleAPIError(rctx, w, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "parse-nodes"))
+			return
+		}
+	}
+
+	endpoints := a.handler.Endpoints
+	if nodes {
+		endpoints = a.handler.NodeEndpoints
+	}
+	r, err := endpoints(rctx, instanceID)
 	if err != nil {
 		a.handleAPIError(rctx, w, err)
 		return
@@ -106,6 +285,22 @@ func (a API) ServiceUsage(w http.ResponseWriter, req *http.Request) {
 	})
 	rctx.Logger.Info("service-usage")
 
+	query := req.URL.Query()
+	if query.Get("from") != "" {
+		ur, err := parseUsageRange(query, time.Now())
+		if err != nil {
+			a.handleAPIError(rctx, w, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "parse-usage-range"))
+			return
+		}
+		r, err := a.handler.ServiceUsageHistory(rctx, instanceID, *ur)
+		if err != nil {
+			a.handleAPIError(rctx, w, err)
+			return
+		}
+		a.respond(w, http.StatusOK, r)
+		return
+	}
+
 	r, err := a.handler.ServiceUsage(rctx, instanceID)
 	if err != nil {
 		a.handleAPIError(rctx, w, err)
@@ -114,10 +309,44 @@ func (a API) ServiceUsage(w http.ResponseWriter, req *http.Request) {
 	a.respond(w, http.StatusOK, r)
 }
 
-// CreateUpdateServiceDefinition is not implemented
+// parseUsageRange parses the from, to and step query parameters.
+// From and to are RFC 3339 timestamps, to defaults to now. Step is a duration such as "5m".
+func parseUsageRange(query url.Values, now time.Time) (*UsageRange, error) {
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %w", err)
+	}
+	r := UsageRange{From: from, To: now}
+	if to := query.Get("to"); to != "" {
+		r.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	r.Step = defaultUsageStep(r.From, r.To)
+	if step := query.Get("step"); step != "" {
+		r.Step, err = time.ParseDuration(step)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step: %w", err)
+		}
+	}
+	return &r, nil
+}
+
+// CreateUpdateServiceDefinition creates or updates a service definition
 func (a API) CreateUpdateServiceDefinition(w http.ResponseWriter, req *http.Request) {
 	rctx := reqcontext.NewReqContext(req.Context(), a.logger, nil)
-	rctx.Logger.Info("endpoints")
+	rctx.Logger.Info("create-update-service-definition")
+
+	dryRun := false
+	if d := req.URL.Query().Get("dry_run"); d != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(d)
+		if err != nil {
+			a.handleAPIError(rctx, w, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "parse-dry-run"))
+			return
+		}
+	}
 
 	var sd ServiceDefinitionRequest
 	err := json.NewDecoder(req.Body).Decode(&sd)
@@ -127,14 +356,15 @@ func (a API) CreateUpdateServiceDefinition(w http.ResponseWriter, req *http.Requ
 	}
 	defer req.Body.Close()
 
-	err = a.handler.CreateUpdateServiceDefinition(rctx, &sd)
+	err = a.handler.CreateUpdateServiceDefinition(rctx, &sd, dryRun)
 	if err != nil {
 		a.handleAPIError(rctx, w, err)
+		return
 	}
 	a.respond(w, http.StatusNoContent, nil)
 }
 
-// DeleteServiceDefinition is not implemented
+// DeleteServiceDefinition deletes a service or plan definition
 func (a API) DeleteServiceDefinition(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	id := vars["id"]
@@ -152,7 +382,50 @@ func (a API) DeleteServiceDefinition(w http.ResponseWriter, req *http.Request) {
 	a.respond(w, http.StatusNoContent, nil)
 }
 
-// CreateBackup is not implemented
+// ServiceDefinitionRevisions lists the revisions of a service definition
+func (a API) ServiceDefinitionRevisions(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	rctx := reqcontext.NewReqContext(req.Context(), a.logger, lager.Data{
+		"id": id,
+	})
+	rctx.Logger.Info("service-definition-revisions")
+
+	r, err := a.handler.ServiceDefinitionRevisions(rctx, id)
+	if err != nil {
+		a.handleAPIError(rctx, w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, r)
+}
+
+// RollbackServiceDefinition rolls a service definition back to a previous revision
+func (a API) RollbackServiceDefinition(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	rctx := reqcontext.NewReqContext(req.Context(), a.logger, lager.Data{
+		"id":       id,
+		"revision": vars["revision"],
+	})
+	rctx.Logger.Info("rollback-service-definition")
+
+	revision, err := strconv.Atoi(vars["revision"])
+	if err != nil {
+		a.handleAPIError(rctx, w, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "parse-revision"))
+		return
+	}
+
+	r, err := a.handler.RollbackServiceDefinition(rctx, id, revision)
+	if err != nil {
+		a.handleAPIError(rctx, w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, r)
+}
+
+// CreateBackup starts a backup
 func (a API) CreateBackup(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["service_instance_id"]
@@ -161,22 +434,24 @@ func (a API) CreateBackup(w http.ResponseWriter, req *http.Request) {
 	})
 	rctx.Logger.Info("create-backup")
 
+	// The request has no required fields, so the body may be left out.
+	defer req.Body.Close()
 	var br BackupRequest
 	err := json.NewDecoder(req.Body).Decode(&br)
-	if err != nil {
+	if err != nil && !errors.Is(err, io.EOF) {
 		a.handleAPIError(rctx, w, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "json-unmarshal"))
 		return
 	}
-	defer req.Body.Close()
 
 	b, err := a.handler.CreateBackup(rctx, instanceID, &br)
 	if err != nil {
 		a.handleAPIError(rctx, w, err)
+		return
 	}
 	a.respond(w, http.StatusCreated, b)
 }
 
-// DeleteBackup is not implemented
+// DeleteBackup deletes a backup
 func (a API) DeleteBackup(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["service_instance_id"]
@@ -187,15 +462,15 @@ func (a API) DeleteBackup(w http.ResponseWriter, req *http.Request) {
 	})
 	rctx.Logger.Info("delete-backup")
 
-	r, err := a.handler.DeleteBackup(rctx, instanceID, backupID)
+	err := a.handler.DeleteBackup(rctx, instanceID, backupID)
 	if err != nil {
 		a.handleAPIError(rctx, w, err)
 		return
 	}
-	a.respond(w, http.StatusOK, r)
+	a.respond(w, http.StatusAccepted, nil)
 }
 
-// Backup is not implemented
+// Backup returns a backup
 func (a API) Backup(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["service_instance_id"]
@@ -214,7 +489,7 @@ func (a API) Backup(w http.ResponseWriter, req *http.Request) {
 	a.respond(w, http.StatusOK, r)
 }
 
-// ListBackups is not implemented
+// ListBackups lists backups
 func (a API) ListBackups(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["service_instance_id"]
@@ -231,7 +506,49 @@ func (a API) ListBackups(w http.ResponseWriter, req *http.Request) {
 	a.respond(w, http.StatusOK, r)
 }
 
-// RestoreBackup is not implemented
+// BackupSchedule returns the backup schedule
+func (a API) BackupSchedule(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	instanceID := vars["service_instance_id"]
+	rctx := reqcontext.NewReqContext(req.Context(), a.logger, lager.Data{
+		"instance-id": instanceID,
+	})
+	rctx.Logger.Info("backup-schedule")
+
+	r, err := a.handler.BackupSchedule(rctx, instanceID)
+	if err != nil {
+		a.handleAPIError(rctx, w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, r)
+}
+
+// SetBackupSchedule sets the backup schedule
+func (a API) SetBackupSchedule(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	instanceID := vars["service_instance_id"]
+	rctx := reqcontext.NewReqContext(req.Context(), a.logger, lager.Data{
+		"instance-id": instanceID,
+	})
+	rctx.Logger.Info("set-backup-schedule")
+
+	var s BackupSchedule
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err != nil {
+		a.handleAPIError(rctx, w, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "json-unmarshal"))
+		return
+	}
+	defer req.Body.Close()
+
+	r, err := a.handler.SetBackupSchedule(rctx, instanceID, &s)
+	if err != nil {
+		a.handleAPIError(rctx, w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, r)
+}
+
+// RestoreBackup starts a restore
 func (a API) RestoreBackup(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["service_instance_id"]
@@ -242,23 +559,24 @@ func (a API) RestoreBackup(w http.ResponseWriter, req *http.Request) {
 	})
 	rctx.Logger.Info("restore-backup")
 
+	// In place restores have no required fields, so the body may be left out.
+	defer req.Body.Close()
 	var restore RestoreRequest
 	err := json.NewDecoder(req.Body).Decode(&restore)
-	if err != nil {
+	if err != nil && !errors.Is(err, io.EOF) {
 		a.handleAPIError(rctx, w, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "json-unmarshal"))
 		return
 	}
-	defer req.Body.Close()
 
 	r, err := a.handler.RestoreBackup(rctx, instanceID, backupID, &restore)
 	if err != nil {
 		a.handleAPIError(rctx, w, err)
 		return
 	}
-	a.respond(w, http.StatusOK, r)
+	a.respond(w, http.StatusAccepted, r)
 }
 
-// RestoreStatus is not implemented
+// RestoreStatus returns the status of a restore
 func (a API) RestoreStatus(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["service_instance_id"]
@@ -280,17 +598,30 @@ func (a API) RestoreStatus(w http.ResponseWriter, req *http.Request) {
 	a.respond(w, http.StatusOK, r)
 }
 
-// APIDocs is not implemented
+// APIDocs returns the OpenAPI document of the whole custom API
 func (a API) APIDocs(w http.ResponseWriter, req *http.Request) {
+	rctx := reqcontext.NewReqContext(req.Context(), a.logger, nil)
+	rctx.Logger.Info("api-docs")
+
+	r, err := a.handler.APIDocs(rctx)
+	if err != nil {
+		a.handleAPIError(rctx, w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, r)
+}
+
+// InstanceAPIDocs returns the OpenAPI document for a service instance
+func (a API) InstanceAPIDocs(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	instanceID := vars["service_instance_id"]
 
 	rctx := reqcontext.NewReqContext(req.Context(), a.logger, lager.Data{
 		"instance-id": instanceID,
 	})
-	rctx.Logger.Info("api-docs")
+	rctx.Logger.Info("instance-api-docs")
 
-	r, err := a.handler.APIDocs(rctx, instanceID)
+	r, err := a.handler.InstanceAPIDocs(rctx, instanceID)
 	if err != nil {
 		a.handleAPIError(rctx, w, err)
 		return
@@ -0,0 +1,180 @@
+package custom
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+)
+
+func TestOpenAPI_DocumentsAllRoutes(t *testing.T) {
+	doc, err := newOpenAPI(routes)
+	require.NoError(t, err)
+
+	router := mux.NewRouter()
+	attachRoutes(router, API{})
+
+	n := 0
+	err = router.Walk(func(r *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := r.GetPathTemplate()
+		require.NoError(t, err)
+		methods, err := r.GetMethods()
+		require.NoError(t, err)
+		for _, m := range methods {
+			n++
+			assert.Contains(t, doc.Paths[path], strings.ToLower(m), "route %s %s is not documented", m, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, len(routes), n)
+}
+
+func TestOpenAPI_DocumentsAllOperations(t *testing.T) {
+	documented := map[string]bool{}
+	for _, r := range routes {
+		for _, op := range r.operations {
+			documented[op] = true
+		}
+	}
+	for i := 0; i < apiSpecType.NumMethod(); i++ {
+		name := apiSpecType.Method(i).Name
+		assert.True(t, documented[name], "APISpec method %s is not served by any route", name)
+	}
+}
+
+func TestOpenAPI_References(t *testing.T) {
+	doc, err := newOpenAPI(routes)
+	require.NoError(t, err)
+
+	raw, err := json.Marshal(doc)
+	require.NoError(t, err)
+
+	var refs []string
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, e := range v {
+				if s, ok := e.(string); ok && k == "$ref" {
+					refs = append(refs, s)
+				}
+				collect(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				collect(e)
+			}
+		}
+	}
+	var generic interface{}
+	require.NoError(t, json.Unmarshal(raw, &generic))
+	collect(generic)
+
+	require.NotEmpty(t, refs)
+	for _, ref := range refs {
+		assert.Contains(t, doc.Components.Schemas, strings.TrimPrefix(ref, "#/components/schemas/"))
+	}
+
+	backup := doc.Paths["/custom/service_instances/{service_instance_id}/backups"]["post"]
+	require.NotNil(t, backup)
+	assert.Equal(t, "CreateBackup", backup.OperationID)
+	assert.Equal(t, "#/components/schemas/BackupRequest", backup.RequestBody.Content["application/json"].Schema.Ref)
+	assert.False(t, backup.RequestBody.Required, "backups can be requested without body")
+	restore := doc.Paths["/custom/service_instances/{service_instance_id}/backups/{backup_id}/restores"]["post"]
+	require.NotNil(t, restore)
+	assert.False(t, restore.RequestBody.Required, "in place restores can be requested without body")
+	assert.Equal(t, "#/components/schemas/Backup", backup.Responses["201"].Content["application/json"].Schema.Ref)
+	assert.Equal(t, []OpenAPIParameter{
+		{Name: "service_instance_id", In: "path", Required: true, Schema: &OpenAPISchema{Type: "string"}},
+	}, backup.Parameters)
+
+	assert.Contains(t, doc.Components.Schemas["Backup"].Required, "id")
+	assert.NotContains(t, doc.Components.Schemas["Backup"].Required, "started_at")
+	assert.Empty(t, doc.Paths["/custom/admin/service-definition/{id}"]["delete"].Responses["204"].Content)
+	assert.Equal(t, http.StatusText(http.StatusNoContent), doc.Paths["/custom/admin/service-definition/{id}"]["delete"].Responses["204"].Description)
+}
+
+func TestAPIHandler_APIDocs(t *testing.T) {
+	doc, err := APIHandler{}.APIDocs(reqcontext.NewReqContext(context.TODO(), lager.NewLogger("test"), nil))
+	require.NoError(t, err)
+	assert.Contains(t, doc.Paths, "/custom/admin/service-definition")
+	assert.Contains(t, doc.Paths, "/custom/api-docs")
+	assert.Contains(t, doc.Paths, "/custom/service_instances/{service_instance_id}/api-docs")
+}
+
+func TestNewInstanceOpenAPI(t *testing.T) {
+	endpoints := []Endpoint{
+		{Name: EndpointNameRedis, Destination: "redis.example.com", Ports: "6379", Protocol: "tcp"},
+		{Name: EndpointNameSentinel, Destination: "redis.example.com", Ports: "26379", Protocol: "tcp", SentinelMaster: &SentinelMaster{Name: "redis1"}},
+	}
+	doc, err := newInstanceOpenAPI("1", crossplane.RedisService, endpoints)
+	require.NoError(t, err)
+
+	assert.Contains(t, doc.Paths, "/custom/service_instances/{service_instance_id}/backups")
+	assert.NotContains(t, doc.Paths, "/custom/admin/service-definition")
+	assert.Contains(t, doc.Info.Description, "- Redis: `redis.example.com:6379`")
+	assert.Contains(t, doc.Info.Description, "- Sentinel: `redis.example.com:26379`")
+	assert.Contains(t, doc.Info.Description, "address of the master `redis1`")
+	assert.Equal(t, "1", doc.Paths["/custom/service_instances/{service_instance_id}/endpoint"]["get"].Parameters[0].Example)
+
+	doc, err = newInstanceOpenAPI("2", crossplane.MariaDBUserService, nil)
+	require.NoError(t, err)
+	assert.NotContains(t, doc.Paths, "/custom/service_instances/{service_instance_id}/backups")
+	assert.NotContains(t, doc.Paths, "/custom/service_instances/{service_instance_id}/usage")
+	assert.Contains(t, doc.Paths, "/custom/service_instances/{service_instance_id}/endpoint")
+	assert.Contains(t, doc.Info.Description, "available once the instance is ready")
+
+	doc, err = newInstanceOpenAPI("3", crossplane.MariaDBService, nil)
+	require.NoError(t, err)
+	assert.Contains(t, doc.Info.Description, "`parent_reference` parameter set to `3`")
+}
+
+// createBackupSpec accepts every backup request.
+type createBackupSpec struct {
+	APISpec
+}
+
+func (createBackupSpec) CreateBackup(rctx *reqcontext.ReqContext, instanceID string, b *BackupRequest) (*Backup, error) {
+	return &Backup{ID: "backup-1"}, nil
+}
+
+func TestAPI_CreateBackup_WithoutBody(t *testing.T) {
+	a := API{handler: createBackupSpec{}, logger: lager.NewLogger("test")}
+	w := httptest.NewRecorder()
+	a.CreateBackup(w, httptest.NewRequest(http.MethodPost, "/custom/service_instances/1/backups", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+// restoreBackupSpec accepts every restore request and records it.
+type restoreBackupSpec struct {
+	APISpec
+	request *RestoreRequest
+}
+
+func (s *restoreBackupSpec) RestoreBackup(rctx *reqcontext.ReqContext, instanceID, backupID string, r *RestoreRequest) (*Restore, error) {
+	s.request = r
+	return &Restore{ID: "restore-1"}, nil
+}
+
+func TestAPI_RestoreBackup_WithoutBody(t *testing.T) {
+	spec := &restoreBackupSpec{}
+	a := API{handler: spec, logger: lager.NewLogger("test")}
+	w := httptest.NewRecorder()
+	a.RestoreBackup(w, httptest.NewRequest(http.MethodPost, "/custom/service_instances/1/backups/backup-1/restores", nil))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, &RestoreRequest{}, spec.request)
+
+	w = httptest.NewRecorder()
+	a.RestoreBackup(w, httptest.NewRequest(http.MethodPost, "/custom/service_instances/1/backups/backup-1/restores", strings.NewReader("{")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
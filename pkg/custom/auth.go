@@ -0,0 +1,283 @@
+package custom
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+)
+
+// Role grants access to the routes of the custom API. Every role includes the ones below it.
+// Below the admin role, instances can only be accessed with bearer tokens naming their tenant, see authorizeInstance.
+type Role int
+
+const (
+	// RoleReadOnly can read the endpoints, usage, backups and documentation of instances.
+	RoleReadOnly Role = iota + 1
+	// RolePlatform can additionally take, delete and restore backups and change backup schedules.
+	RolePlatform
+	// RoleAdmin can additionally manage service definitions.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "read-only"
+	case RolePlatform:
+		return "platform"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+// Credential is a username and password granting a role.
+type Credential struct {
+	Username string
+	Password string
+	Role     Role
+}
+
+// Claims of the bearer tokens accepted by the custom API.
+const (
+	// RoleClaim is the role granted by a token, read-only if missing. Tokens can't grant the admin role.
+	RoleClaim = "role"
+	// InstancesClaim lists the IDs of the instances a token grants access to.
+	InstancesClaim = "instances"
+	// OrganizationsClaim lists the organizations a token grants access to the instances of.
+	OrganizationsClaim = "organizations"
+)
+
+// Tokens configures the bearer tokens accepted by the custom API.
+type Tokens struct {
+	// Keys verify the signatures of tokens.
+	Keys *jwt.KeyRegister
+	// Issuer and Audience must be named by the iss and aud claims of tokens, which distinguishes tokens
+	// of the custom API from other tokens signed by the same keys.
+	Issuer   string
+	Audience string
+}
+
+// jwtLeeway is the clock skew tolerated when checking the expiry of tokens.
+const jwtLeeway = 30 * time.Second
+
+// principal is the identity a request has been authenticated as.
+type principal struct {
+	role Role
+	// scope limits the instances which can be accessed, nil if all instances can be accessed.
+	scope *tokenScope
+}
+
+// tokenScope is the set of instances a bearer token grants access to.
+type tokenScope struct {
+	instances     map[string]bool
+	organizations map[string]bool
+}
+
+// allows returns true if the scope includes the instance, either by its ID or by the organization it was provisioned in.
+func (s *tokenScope) allows(instance *crossplane.Instance) bool {
+	if s.instances[instance.ID()] {
+		return true
+	}
+	org := instance.Composite.GetAnnotations()[OrganizationAnnotation]
+	return org != "" && s.organizations[org]
+}
+
+// empty returns true if the scope doesn't name any instance or organization.
+func (s *tokenScope) empty() bool {
+	return len(s.instances) == 0 && len(s.organizations) == 0
+}
+
+type principalKey struct{}
+
+const notAuthorized = "Not Authorized"
+
+var errInstanceAccessDenied = apiresponses.NewFailureResponseBuilder(
+	errors.New("access to the instance is not granted"),
+	http.StatusForbidden,
+	"instance-access-denied").
+	WithErrorKey("Forbidden").
+	Build()
+
+var errMissingTenant = apiresponses.NewFailureResponseBuilder(
+	errors.New("credentials don't name the tenant the request is made in"),
+	http.StatusForbidden,
+	"missing-tenant").
+	WithErrorKey("Forbidden").
+	Build()
+
+var errInsufficientRole = apiresponses.NewFailureResponseBuilder(
+	errors.New("credentials don't grant access to this route"),
+	http.StatusForbidden,
+	"insufficient-role").
+	WithErrorKey("Forbidden").
+	Build()
+
+// authenticator authenticates requests using basic auth or bearer tokens and adds the principal to the request context.
+type authenticator struct {
+	credentials []hashedCredential
+	tokens      *Tokens
+}
+
+type hashedCredential struct {
+	username [32]byte
+	password [32]byte
+	role     Role
+}
+
+// newAuthenticator returns an authenticator accepting the credentials and the bearer tokens.
+// Bearer tokens aren't accepted if tokens is nil.
+func newAuthenticator(credentials []Credential, tokens *Tokens) *authenticator {
+	a := &authenticator{tokens: tokens}
+	for _, c := range credentials {
+		a.credentials = append(a.credentials, hashedCredential{
+			username: sha256.Sum256([]byte(c.Username)),
+			password: sha256.Sum256([]byte(c.Password)),
+			role:     c.Role,
+		})
+	}
+	return a
+}
+
+// Wrap responds with 401 to requests without valid credentials.
+func (a *authenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var p *principal
+		if _, err := jwt.BearerToken(req.Header); err == nil && a.tokens != nil {
+			p = a.authenticateToken(req)
+		} else if role, ok := a.authenticate(req); ok {
+			p = &principal{role: role}
+		}
+		if p == nil {
+			http.Error(w, notAuthorized, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), principalKey{}, p)))
+	})
+}
+
+// authenticateToken verifies the bearer token of the request, nil if it isn't valid.
+// Tokens must expire and be issued for the custom API, they grant access to the instances listed in their claims.
+func (a *authenticator) authenticateToken(req *http.Request) *principal {
+	claims, err := a.tokens.Keys.CheckHeader(req)
+	if err != nil || claims.Expires == nil || claims.AcceptTemporal(time.Now(), jwtLeeway) != nil {
+		return nil
+	}
+	if claims.Issuer != a.tokens.Issuer || !hasAudience(claims, a.tokens.Audience) {
+		return nil
+	}
+
+	p := &principal{
+		role: RoleReadOnly,
+		scope: &tokenScope{
+			instances:     stringSetClaim(claims, InstancesClaim),
+			organizations: stringSetClaim(claims, OrganizationsClaim),
+		},
+	}
+	if r, ok := claims.String(RoleClaim); ok {
+		switch r {
+		case RoleReadOnly.String():
+		case RolePlatform.String():
+			p.role = RolePlatform
+		default:
+			return nil
+		}
+	}
+	return p
+}
+
+// hasAudience returns true if the audience is named by the claims.
+// Unlike jwt.Registered.AcceptAudience, tokens without an audience are rejected.
+func hasAudience(claims *jwt.Claims, audience string) bool {
+	for _, a := range claims.Audiences {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// stringSetClaim returns the strings of a claim holding an array of strings.
+func stringSetClaim(claims *jwt.Claims, name string) map[string]bool {
+	set := map[string]bool{}
+	values, _ := claims.Set[name].([]interface{})
+	for _, v := range values {
+		if s, ok := v.(string); ok && s != "" {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+// authenticate returns the highest role granted by the credentials of the request.
+// All credentials are compared in constant time to not leak which usernames exist.
+func (a *authenticator) authenticate(req *http.Request) (Role, bool) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return 0, false
+	}
+	u := sha256.Sum256([]byte(username))
+	p := sha256.Sum256([]byte(password))
+	var role Role
+	for _, c := range a.credentials {
+		if subtle.ConstantTimeCompare(c.username[:], u[:])&subtle.ConstantTimeCompare(c.password[:], p[:]) == 1 && c.role > role {
+			role = c.role
+		}
+	}
+	return role, role != 0
+}
+
+// requestPrincipal returns the principal the request has been authenticated as, nil if it isn't authenticated.
+func requestPrincipal(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// requestRole returns the role the request has been authenticated with.
+func requestRole(ctx context.Context) Role {
+	if p := requestPrincipal(ctx); p != nil {
+		return p.role
+	}
+	return 0
+}
+
+// authorizeInstance returns an error if the request isn't allowed to access the instance.
+// Admins can access all instances and bearer tokens the instances they grant access to. Other credentials are only
+// held by the platform and the marketplace, which name the tenant they act for in the originating identity. It must
+// match the tenant the instance was provisioned for, see authorizeTenant. Requests with a bearer token made on behalf
+// of a platform user must additionally match the platform and space of the instance, see authorizeIdentity.
+func authorizeInstance(ctx context.Context, instance *crossplane.Instance) error {
+	p := requestPrincipal(ctx)
+	switch {
+	case p == nil:
+		return errInstanceAccessDenied
+	case p.scope == nil && p.role == RoleAdmin:
+		return nil
+	case p.scope != nil && p.scope.empty():
+		return errMissingTenant
+	case p.scope != nil && !p.scope.allows(instance):
+		return errInstanceAccessDenied
+	}
+	identity, err := originatingIdentity(ctx)
+	if err != nil {
+		return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-originating-identity")
+	}
+	switch {
+	case p.scope == nil && identity == nil:
+		return errMissingTenant
+	case p.scope == nil:
+		return authorizeTenant(identity, instance)
+	case identity != nil:
+		return authorizeIdentity(identity, instance)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package custom
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/crossplane/crossplane-runtime/pkg/resource/unstructured/composite"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/jwt"
+	"github.com/pivotal-cf/brokerapi/v8/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+)
+
+func TestConfig_Credentials(t *testing.T) {
+	cfg := Config{}
+	assert.Equal(t, []Credential{{Username: "broker", Password: "pw", Role: RolePlatform}}, cfg.Credentials("broker", "pw"),
+		"the broker credentials must grant the platform role by default")
+
+	cfg.BrokerRole = RoleReadOnly
+	assert.Equal(t, []Credential{{Username: "broker", Password: "pw", Role: RoleReadOnly}}, cfg.Credentials("broker", "pw"))
+
+	cfg.BrokerRole = RolePlatform
+	cfg.AdminCredential = &Credential{Username: "admin", Password: "admin-pw", Role: RoleAdmin}
+	cfg.ReadOnlyCredential = &Credential{Username: "portal", Password: "portal-pw", Role: RoleReadOnly}
+	assert.Equal(t, []Credential{
+		{Username: "broker", Password: "pw", Role: RolePlatform},
+		{Username: "admin", Password: "admin-pw", Role: RoleAdmin},
+		{Username: "portal", Password: "portal-pw", Role: RoleReadOnly},
+	}, cfg.Credentials("broker", "pw"))
+}
+
+func TestReadConfig_Credentials(t *testing.T) {
+	env := map[string]string{EnvReadOnlyUsername: "portal"}
+	_, err := ReadConfig(func(k string) string { return env[k] })
+	assert.EqualError(t, err, "OSB_READONLY_USERNAME and OSB_READONLY_PASSWORD must be set together")
+
+	env = map[string]string{EnvBrokerRole: "admin"}
+	_, err = ReadConfig(func(k string) string { return env[k] })
+	assert.EqualError(t, err, `OSB_CUSTOM_API_BROKER_ROLE must be "read-only" or "platform"`)
+
+	env = map[string]string{EnvBrokerRole: "platform"}
+	cfg, err := ReadConfig(func(k string) string { return env[k] })
+	require.NoError(t, err)
+	assert.Equal(t, RolePlatform, cfg.BrokerRole)
+}
+
+func TestConfig_Tokens(t *testing.T) {
+	keys := &jwt.KeyRegister{Secrets: [][]byte{testSecret}}
+	cfg, err := ReadConfig(func(string) string { return "" })
+	require.NoError(t, err)
+	assert.Nil(t, cfg.Tokens(keys), "tokens must not be accepted without an issuer")
+
+	env := map[string]string{EnvTokenIssuer: "portal"}
+	cfg, err = ReadConfig(func(k string) string { return env[k] })
+	require.NoError(t, err)
+	assert.Equal(t, &Tokens{Keys: keys, Issuer: "portal", Audience: defaultTokenAudience}, cfg.Tokens(keys))
+	assert.Nil(t, cfg.Tokens(nil))
+}
+
+func TestAPI_Authorization(t *testing.T) {
+	router := mux.NewRouter()
+	attachRoutes(router, API{logger: lager.NewLogger("test")})
+	router.Use(newAuthenticator([]Credential{
+		{Username: "broker", Password: "pw", Role: RolePlatform},
+		{Username: "portal", Password: "portal-pw", Role: RoleReadOnly},
+	}, testTokens).Wrap)
+
+	tests := map[string]struct {
+		method, path       string
+		username, password string
+		token              string
+		want               int
+	}{
+		"missing credentials": {
+			method: http.MethodGet, path: "/custom/service_instances/1/endpoint",
+			want: http.StatusUnauthorized,
+		},
+		"wrong password": {
+			method: http.MethodGet, path: "/custom/service_instances/1/endpoint",
+			username: "portal", password: "pw",
+			want: http.StatusUnauthorized,
+		},
+		"read-only creating backups": {
+			method: http.MethodPost, path: "/custom/service_instances/1/backups",
+			username: "portal", password: "portal-pw",
+			want: http.StatusForbidden,
+		},
+		"platform managing services": {
+			method: http.MethodDelete, path: "/custom/admin/service-definition/1",
+			username: "broker", password: "pw",
+			want: http.StatusForbidden,
+		},
+		"token with wrong signature": {
+			method: http.MethodGet, path: "/custom/service_instances/1/endpoint",
+			token: signTestToken(t, []byte("other"), time.Hour, nil),
+			want:  http.StatusUnauthorized,
+		},
+		"expired token": {
+			method: http.MethodGet, path: "/custom/service_instances/1/endpoint",
+			token: signTestToken(t, testSecret, -time.Hour, nil),
+			want:  http.StatusUnauthorized,
+		},
+		"read-only token creating backups": {
+			method: http.MethodPost, path: "/custom/service_instances/1/backups",
+			token: signTestToken(t, testSecret, time.Hour, nil),
+			want:  http.StatusForbidden,
+		},
+		"token of another issuer": {
+			method: http.MethodGet, path: "/custom/service_instances/1/endpoint",
+			token: signTestTokenFor(t, "other", testTokens.Audience, nil),
+			want:  http.StatusUnauthorized,
+		},
+		"token for another audience": {
+			method: http.MethodGet, path: "/custom/service_instances/1/endpoint",
+			token: signTestTokenFor(t, testTokens.Issuer, "osb-api", nil),
+			want:  http.StatusUnauthorized,
+		},
+		"token without audience": {
+			method: http.MethodGet, path: "/custom/service_instances/1/endpoint",
+			token: signTestTokenFor(t, testTokens.Issuer, "", nil),
+			want:  http.StatusUnauthorized,
+		},
+		"token granting the admin role": {
+			method: http.MethodDelete, path: "/custom/admin/service-definition/1",
+			token: signTestToken(t, testSecret, time.Hour, map[string]interface{}{RoleClaim: "admin"}),
+			want:  http.StatusUnauthorized,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+var (
+	testSecret = []byte("secret")
+	testTokens = &Tokens{Keys: &jwt.KeyRegister{Secrets: [][]byte{testSecret}}, Issuer: "portal", Audience: "custom-api"}
+)
+
+func signTestToken(t *testing.T, secret []byte, expiresIn time.Duration, set map[string]interface{}) string {
+	claims := &jwt.Claims{Set: set}
+	claims.Expires = jwt.NewNumericTime(time.Now().Add(expiresIn))
+	claims.Issuer = testTokens.Issuer
+	claims.Audiences = []string{testTokens.Audience}
+	token, err := claims.HMACSign(jwt.HS256, secret)
+	require.NoError(t, err)
+	return string(token)
+}
+
+// signTestTokenFor returns a valid token signed with the test secret naming the given issuer and audience.
+func signTestTokenFor(t *testing.T, issuer, audience string, set map[string]interface{}) string {
+	claims := &jwt.Claims{Set: set}
+	claims.Expires = jwt.NewNumericTime(time.Now().Add(time.Hour))
+	claims.Issuer = issuer
+	if audience != "" {
+		claims.Audiences = []string{audience}
+	}
+	token, err := claims.HMACSign(jwt.HS256, testSecret)
+	require.NoError(t, err)
+	return string(token)
+}
+
+func TestAuthenticator_Token(t *testing.T) {
+	a := newAuthenticator(nil, testTokens)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, testSecret, time.Hour, map[string]interface{}{
+		RoleClaim:          "platform",
+		InstancesClaim:     []interface{}{"1-1-1"},
+		OrganizationsClaim: []interface{}{"org-1"},
+	}))
+
+	p := a.authenticateToken(req)
+	require.NotNil(t, p)
+	assert.Equal(t, RolePlatform, p.role)
+	ctx := context.WithValue(context.TODO(), principalKey{}, p)
+
+	granted := composite.New()
+	granted.SetName("1-1-1")
+	assert.NoError(t, authorizeInstance(ctx, &crossplane.Instance{Composite: granted}))
+
+	sameOrg := composite.New()
+	sameOrg.SetName("1-1-2")
+	sameOrg.SetAnnotations(map[string]string{OrganizationAnnotation: "org-1"})
+	assert.NoError(t, authorizeInstance(ctx, &crossplane.Instance{Composite: sameOrg}))
+
+	otherOrg := composite.New()
+	otherOrg.SetName("1-1-3")
+	otherOrg.SetAnnotations(map[string]string{OrganizationAnnotation: "org-2"})
+	assert.Equal(t, errInstanceAccessDenied, authorizeInstance(ctx, &crossplane.Instance{Composite: otherOrg}))
+
+	unannotated := composite.New()
+	unannotated.SetName("1-1-4")
+	assert.Equal(t, errInstanceAccessDenied, authorizeInstance(ctx, &crossplane.Instance{Composite: unannotated}),
+		"instances without organization must only be granted by their ID")
+
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, testSecret, time.Hour, nil))
+	unscoped := context.WithValue(context.TODO(), principalKey{}, a.authenticateToken(req))
+	assert.Equal(t, errMissingTenant, authorizeInstance(unscoped, &crossplane.Instance{Composite: granted}))
+
+	basic := context.WithValue(context.TODO(), principalKey{}, &principal{role: RolePlatform})
+	assert.Equal(t, errMissingTenant, authorizeInstance(basic, &crossplane.Instance{Composite: otherOrg}),
+		"basic auth without originating identity doesn't name a tenant")
+	assert.NoError(t, authorizeInstance(adminContext(), &crossplane.Instance{Composite: otherOrg}), "admins can access all instances")
+	assert.Equal(t, errInstanceAccessDenied, authorizeInstance(context.TODO(), &crossplane.Instance{Composite: otherOrg}))
+}
+
+func TestAuthorizeInstance_OriginatingIdentity(t *testing.T) {
+	xr := composite.New()
+	xr.SetName("1-1-1")
+	xr.SetAnnotations(map[string]string{
+		PlatformAnnotation:     "cloudfoundry",
+		OrganizationAnnotation: "org-1",
+		SpaceAnnotation:        "space-1",
+	})
+	instance := &crossplane.Instance{Composite: xr}
+	org1 := &principal{role: RolePlatform, scope: &tokenScope{organizations: map[string]bool{"org-1": true}}}
+	org2 := &principal{role: RolePlatform, scope: &tokenScope{organizations: map[string]bool{"org-2": true}}}
+	basic := &principal{role: RolePlatform}
+	readOnly := &principal{role: RoleReadOnly}
+
+	tests := map[string]struct {
+		principal *principal
+		identity  string
+		want      error
+	}{
+		"token without identity": {
+			principal: org1,
+		},
+		"token of another organization without identity": {
+			principal: org2,
+			want:      errInstanceAccessDenied,
+		},
+		"basic auth without identity": {
+			principal: basic,
+			want:      errMissingTenant,
+		},
+		"same organization": {
+			principal: org1,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1"}`),
+		},
+		"same space": {
+			principal: org1,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1","space_guid":"space-1"}`),
+		},
+		"without organization": {
+			principal: org1,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1"}`),
+		},
+		"other organization": {
+			principal: org1,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-2"}`),
+			want:      errCrossTenantAccess,
+		},
+		"other space": {
+			principal: org1,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1","space_guid":"space-2"}`),
+			want:      errCrossTenantAccess,
+		},
+		"other platform": {
+			principal: org1,
+			identity:  testIdentity("kubernetes", `{"username":"admin","organization_guid":"org-1"}`),
+			want:      errCrossTenantAccess,
+		},
+		"forged organization with token": {
+			principal: org2,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1"}`),
+			want:      errInstanceAccessDenied,
+		},
+		"basic auth": {
+			principal: basic,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1"}`),
+		},
+		"read-only basic auth in the same space": {
+			principal: readOnly,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1","space_guid":"space-1"}`),
+		},
+		"basic auth of another organization": {
+			principal: basic,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-2"}`),
+			want:      errCrossTenantAccess,
+		},
+		"basic auth of another space": {
+			principal: readOnly,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1","space_guid":"space-2"}`),
+			want:      errCrossTenantAccess,
+		},
+		"basic auth of another platform": {
+			principal: basic,
+			identity:  testIdentity("kubernetes", `{"username":"admin","organization_guid":"org-1"}`),
+			want:      errCrossTenantAccess,
+		},
+		"basic auth without organization": {
+			principal: basic,
+			identity:  testIdentity("cloudfoundry", `{"user_id":"1"}`),
+			want:      errMissingTenant,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.WithValue(context.TODO(), principalKey{}, tt.principal)
+			if tt.identity != "" {
+				ctx = context.WithValue(ctx, middlewares.OriginatingIdentityKey, tt.identity)
+			}
+			assert.Equal(t, tt.want, authorizeInstance(ctx, instance))
+		})
+	}
+
+	ctx := context.WithValue(context.TODO(), principalKey{}, org1)
+	ctx = context.WithValue(ctx, middlewares.OriginatingIdentityKey, "cloudfoundry")
+	assert.Error(t, authorizeInstance(ctx, instance), "invalid identities must be rejected")
+
+	unannotated := composite.New()
+	unannotated.SetName("1-1-2")
+	ctx = context.WithValue(context.TODO(), principalKey{}, basic)
+	ctx = context.WithValue(ctx, middlewares.OriginatingIdentityKey, testIdentity("cloudfoundry", `{"user_id":"1","organization_guid":"org-1"}`))
+	assert.Equal(t, errInstanceAccessDenied, authorizeInstance(ctx, &crossplane.Instance{Composite: unannotated}),
+		"instances without tenant must not be accessible with basic auth")
+}
+
+func testIdentity(platform, value string) string {
+	return platform + " " + base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+// adminContext returns a context authenticated with the admin role, which grants access to all instances.
+func adminContext() context.Context {
+	return context.WithValue(context.TODO(), principalKey{}, &principal{role: RoleAdmin})
+}
@@ -0,0 +1,436 @@
+package custom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// OperationLabel marks jobs started by the broker with the operation they perform.
+	OperationLabel = crossplane.SynToolsBase + "/operation"
+	// BackupTypeLabel marks backup jobs as either manual or scheduled.
+	BackupTypeLabel = crossplane.SynToolsBase + "/backup-type"
+	// BackupIDLabel references the backup a restore or prune job operates on.
+	BackupIDLabel = crossplane.SynToolsBase + "/backup"
+	// SourceInstanceIDLabel references the instance the backup restored by a job has been taken of.
+	SourceInstanceIDLabel = crossplane.SynToolsBase + "/source-instance"
+	// RetentionAnnotation is the duration a backup is kept after its job has finished.
+	// Backups without retention are kept until they get deleted.
+	RetentionAnnotation = crossplane.SynToolsBase + "/retention"
+	// ResultAnnotation records the result written to the termination log by the pod of a job on the job,
+	// which keeps it after the pod has been garbage collected.
+	ResultAnnotation = crossplane.SynToolsBase + "/result"
+
+	operationBackup  = "backup"
+	operationRestore = "restore"
+	operationPrune   = "prune"
+
+	// pruneJobTTL is the time prune jobs are kept after they have finished.
+	pruneJobTTL = int32(3600)
+)
+
+// jobResult is written to the termination log by the backup image.
+type jobResult struct {
+	Snapshot string `json:"snapshot,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// backupName returns the name of a backup taken at the given time.
+// The random suffix keeps backups requested within the same second apart. The time is base 36 encoded,
+// so the name of the prune job still fits into the 63 characters of the job name label.
+func backupName(instanceID string, t time.Time) string {
+	return fmt.Sprintf("backup-%s-%s-%s", instanceID, strconv.FormatInt(t.Unix(), 36), utilrand.String(5))
+}
+
+// newBackupJob returns the job taking a backup of the given instance.
+// The cluster is the instance actually holding the data, which is the instance itself
+// for everything but MariaDB databases.
+// Backups are removed by the BackupPruner once the configured retention has passed.
+func newBackupJob(instance, cluster *crossplane.Instance, config *Config, t time.Time) (*batchv1.Job, error) {
+	job, err := newOperationJob(instance, cluster, operationBackup, backupName(instance.ID(), t), config, nil)
+	if err != nil {
+		return nil, err
+	}
+	job.Labels[BackupTypeLabel] = string(BackupManual)
+	if config.BackupRetention > 0 {
+		job.Annotations = map[string]string{RetentionAnnotation: config.BackupRetention.String()}
+	}
+	return job, nil
+}
+
+// restoreName returns the name of a restore started at the given time.
+func restoreName(instanceID string, t time.Time) string {
+	return fmt.Sprintf("restore-%s-%d", instanceID, t.Unix())
+}
+
+// newRestoreJob returns the job restoring the snapshot of a backup taken of the source into the given instance.
+// The source is the instance itself for in place restores.
+// If a target time is given, the binary logs are replayed up to that time after the snapshot has been restored.
+func newRestoreJob(source, instance, cluster *crossplane.Instance, backupID, snapshot string, target *time.Time, config *Config, t time.Time) (*batchv1.Job, error) {
+	env := []corev1.EnvVar{
+		{Name: "SNAPSHOT", Value: snapshot},
+		{Name: "SOURCE_INSTANCE_ID", Value: source.ID()},
+	}
+	if target != nil {
+		env = append(env, corev1.EnvVar{Name: "TARGET_TIME", Value: target.UTC().Format(time.RFC3339)})
+	}
+
+	job, err := newOperationJob(instance, cluster, operationRestore, restoreName(instance.ID(), t), config, env)
+	if err != nil {
+		return nil, err
+	}
+	job.Labels[BackupIDLabel] = backupID
+	job.Labels[SourceInstanceIDLabel] = source.ID()
+	return job, nil
+}
+
+// newPruneJob returns the job removing the stored data of a backup from the backup repository.
+// It runs the prune operation with the environment of the backup job. The snapshot is only known
+// if the backup job has recorded its result, otherwise the snapshots taken by the backup job are
+// looked up by the job name passed as BACKUP_ID.
+func newPruneJob(backupJob *batchv1.Job, snapshot string) *batchv1.Job {
+	labels := map[string]string{
+		crossplane.InstanceIDLabel: backupJob.Labels[crossplane.InstanceIDLabel],
+		OperationLabel:             operationPrune,
+		BackupIDLabel:              backupJob.Name,
+	}
+	spec := *backupJob.Spec.Template.Spec.DeepCopy()
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		c.Name = operationPrune
+		c.Args = []string{operationPrune}
+		c.Env = append(c.Env,
+			corev1.EnvVar{Name: "BACKUP_ID", Value: backupJob.Name},
+			corev1.EnvVar{Name: "SNAPSHOT", Value: snapshot},
+		)
+	}
+
+	var backoffLimit int32
+	ttl := pruneJobTTL
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "prune-" + backupJob.Name,
+			Namespace: backupJob.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       spec,
+			},
+		},
+	}
+}
+
+// newOperationJob returns a job running the given operation of the backup image against an instance.
+// The job is created next to the connection secret of the cluster and gets the connection details
+// as well as the backup repository configuration passed as environment variables.
+// Operations on a MariaDB database are limited to that database.
+func newOperationJob(instance, cluster *crossplane.Instance, operation, name string, config *Config, env []corev1.EnvVar) (*batchv1.Job, error) {
+	namespace, err := operationNamespace(cluster)
+	if err != nil {
+		return nil, err
+	}
+	secretName := cluster.Composite.GetWriteConnectionSecretToReference().Name
+
+	if instance.Labels.ServiceName == crossplane.MariaDBDatabaseService {
+		env = append(env, corev1.EnvVar{Name: "DATABASE", Value: instance.ID()})
+	}
+
+	labels := map[string]string{
+		crossplane.InstanceIDLabel: instance.ID(),
+		OperationLabel:             operation,
+	}
+
+	var backoffLimit int32
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:  operation,
+							Image: config.BackupImage,
+							Args:  []string{operation},
+							Env: append([]corev1.EnvVar{
+								{Name: "SERVICE", Value: string(cluster.Labels.ServiceName)},
+								{Name: "INSTANCE_ID", Value: cluster.ID()},
+								{
+									Name: "JOB_NAME",
+									ValueFrom: &corev1.EnvVarSource{
+										FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['" + batchv1.JobNameLabel + "']"},
+									},
+								},
+								secretEnvVar("HOST", secretName, xrv1.ResourceCredentialsSecretEndpointKey),
+								secretEnvVar("PORT", secretName, xrv1.ResourceCredentialsSecretPortKey),
+								secretEnvVar("PASSWORD", secretName, xrv1.ResourceCredentialsSecretPasswordKey),
+							}, env...),
+							EnvFrom: []corev1.EnvFromSource{
+								{
+									SecretRef: &corev1.SecretEnvSource{
+										LocalObjectReference: corev1.LocalObjectReference{Name: config.BackupSecret},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// operationNamespace returns the namespace the jobs operating on the given cluster run in,
+// which is the namespace of its connection secret.
+func operationNamespace(cluster *crossplane.Instance) (string, error) {
+	secretRef := cluster.Composite.GetWriteConnectionSecretToReference()
+	if secretRef == nil {
+		return "", fmt.Errorf("instance %q has no connection secret", cluster.ID())
+	}
+	return secretRef.Namespace, nil
+}
+
+func secretEnvVar(name, secret, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// backupFromJob returns the backup taken by the given job.
+// The result is the one written by the job pod, if it has already terminated.
+func backupFromJob(job *batchv1.Job, result *jobResult) Backup {
+	b := Backup{
+		ID:        job.Name,
+		Type:      BackupManual,
+		Status:    jobStatus(job),
+		CreatedAt: job.CreationTimestamp.Time,
+	}
+	if t, ok := job.Labels[BackupTypeLabel]; ok {
+		b.Type = BackupType(t)
+	}
+	if job.Status.StartTime != nil {
+		b.StartedAt = &job.Status.StartTime.Time
+	}
+	if job.Status.CompletionTime != nil {
+		b.FinishedAt = &job.Status.CompletionTime.Time
+	}
+
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			b.FinishedAt = &c.LastTransitionTime.Time
+			b.Error = c.Message
+		}
+	}
+
+	if r, err := time.ParseDuration(job.Annotations[RetentionAnnotation]); err == nil && b.FinishedAt != nil {
+		expires := b.FinishedAt.Add(r)
+		b.ExpiresAt = &expires
+	}
+
+	if result != nil {
+		b.Size = result.Size
+		if result.Error != "" {
+			b.Error = result.Error
+		}
+	}
+	return b
+}
+
+// restoreFromJob returns the restore performed by the given job.
+// The result is the one written by the job pod, if it has already terminated.
+func restoreFromJob(job *batchv1.Job, result *jobResult) Restore {
+	r := Restore{
+		ID:         job.Name,
+		BackupID:   job.Labels[BackupIDLabel],
+		InstanceID: job.Labels[crossplane.InstanceIDLabel],
+		Status:     jobStatus(job),
+		CreatedAt:  job.CreationTimestamp.Time,
+	}
+	if job.Status.StartTime != nil {
+		r.StartedAt = &job.Status.StartTime.Time
+	}
+	if job.Status.CompletionTime != nil {
+		r.FinishedAt = &job.Status.CompletionTime.Time
+	}
+
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			r.FinishedAt = &c.LastTransitionTime.Time
+			r.Error = c.Message
+		}
+	}
+
+	if result != nil && result.Error != "" {
+		r.Error = result.Error
+	}
+	return r
+}
+
+// recoveryWindow returns the time range an instance can be recovered to with the given backups.
+// Recovery starts from a backup, which must have finished after the oldest available binary log.
+// The window is nil if there is no such backup.
+func recoveryWindow(backups []Backup, binlogRetention time.Duration, now time.Time) *RecoveryWindow {
+	var w *RecoveryWindow
+	for _, b := range backups {
+		if !recoverableFrom(b, binlogRetention, now) {
+			continue
+		}
+		if w == nil || b.FinishedAt.Before(w.From) {
+			w = &RecoveryWindow{From: *b.FinishedAt, To: now}
+		}
+	}
+	return w
+}
+
+// recoverableFrom returns true if the binary logs written since the backup has finished are still available.
+func recoverableFrom(b Backup, binlogRetention time.Duration, now time.Time) bool {
+	return b.Status == OperationSucceeded &&
+		b.FinishedAt != nil &&
+		b.FinishedAt.After(now.Add(-binlogRetention))
+}
+
+// podResults returns the results written by terminated job pods, keyed by the job name.
+func podResults(pods []corev1.Pod) map[string]*jobResult {
+	results := make(map[string]*jobResult, len(pods))
+	for i := range pods {
+		jobName, ok := pods[i].Labels[batchv1.JobNameLabel]
+		if !ok {
+			continue
+		}
+		if r := podResult(&pods[i]); r != nil {
+			results[jobName] = r
+		}
+	}
+	return results
+}
+
+// podResult returns the result written to the termination log of a job pod, nil if it hasn't terminated yet.
+func podResult(pod *corev1.Pod) *jobResult {
+	var result *jobResult
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Terminated == nil || cs.State.Terminated.Message == "" {
+			continue
+		}
+		var r jobResult
+		if err := json.Unmarshal([]byte(cs.State.Terminated.Message), &r); err != nil {
+			r = jobResult{Error: cs.State.Terminated.Message}
+		}
+		result = &r
+	}
+	return result
+}
+
+// recordedJobResult returns the result recorded on the job, nil if none has been recorded yet.
+func recordedJobResult(job *batchv1.Job) *jobResult {
+	a, ok := job.Annotations[ResultAnnotation]
+	if !ok {
+		return nil
+	}
+	var r jobResult
+	if err := json.Unmarshal([]byte(a), &r); err != nil {
+		return &jobResult{Error: fmt.Sprintf("invalid result: %s", err)}
+	}
+	return &r
+}
+
+// recordJobResult records the result on the job, unless one has already been recorded.
+func recordJobResult(ctx context.Context, cl client.Client, job *batchv1.Job, r *jobResult) error {
+	if _, ok := job.Annotations[ResultAnnotation]; ok {
+		return nil
+	}
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(job.DeepCopy())
+	metav1.SetMetaDataAnnotation(&job.ObjectMeta, ResultAnnotation, string(raw))
+	return cl.Patch(ctx, job, patch)
+}
+
+// RecordJobResults records the results of the pods of backup, restore and prune jobs on their jobs as soon as the
+// pods terminate. The informers must be started separately.
+func RecordJobResults(ctx context.Context, informers cache.Informers, cl client.Client, log lager.Logger) error {
+	informer, err := informers.GetInformer(ctx, &corev1.Pod{})
+	if err != nil {
+		return err
+	}
+	record := func(obj interface{}) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Labels[OperationLabel] == "" || pod.Labels[batchv1.JobNameLabel] == "" {
+			return
+		}
+		r := podResult(pod)
+		if r == nil {
+			return
+		}
+		job := &batchv1.Job{}
+		if err := cl.Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: pod.Labels[batchv1.JobNameLabel]}, job); err != nil {
+			if !apierrors.IsNotFound(err) {
+				log.Error("get-job", err, lager.Data{"pod": pod.Name})
+			}
+			return
+		}
+		if err := recordJobResult(ctx, cl, job, r); err != nil {
+			log.Error("record-job-result", err, lager.Data{"job": job.Name})
+		}
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    record,
+		UpdateFunc: func(_, obj interface{}) { record(obj) },
+	})
+	return err
+}
+
+// jobStatus maps the conditions of a job to the status of the operation it performs.
+func jobStatus(job *batchv1.Job) OperationStatus {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return OperationSucceeded
+		case batchv1.JobFailed:
+			return OperationFailed
+		}
+	}
+	if job.Status.Active > 0 {
+		return OperationRunning
+	}
+	return OperationPending
+}
@@ -0,0 +1,445 @@
+package custom
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/crossplane/crossplane-runtime/pkg/resource/unstructured/composite"
+	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBackupFromJob(t *testing.T) {
+	created := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	started := created.Add(time.Second)
+	finished := created.Add(time.Minute)
+	expires := finished.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		job    *batchv1.Job
+		result *jobResult
+		want   Backup
+	}{
+		{
+			name: "pending backup",
+			job: &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "backup-1",
+					CreationTimestamp: metav1.NewTime(created),
+				},
+			},
+			want: Backup{
+				ID:        "backup-1",
+				Type:      BackupManual,
+				Status:    OperationPending,
+				CreatedAt: created,
+			},
+		},
+		{
+			name: "succeeded scheduled backup",
+			job: &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "backup-1",
+					CreationTimestamp: metav1.NewTime(created),
+					Labels:            map[string]string{BackupTypeLabel: string(BackupScheduled)},
+					Annotations:       map[string]string{RetentionAnnotation: "1h"},
+				},
+				Status: batchv1.JobStatus{
+					StartTime:      &metav1.Time{Time: started},
+					CompletionTime: &metav1.Time{Time: finished},
+					Conditions: []batchv1.JobCondition{
+						{Type: batchv1.JobComplete, Status: corev1.ConditionTrue},
+					},
+				},
+			},
+			result: &jobResult{Snapshot: "abcd", Size: 1024},
+			want: Backup{
+				ID:         "backup-1",
+				Type:       BackupScheduled,
+				Status:     OperationSucceeded,
+				CreatedAt:  created,
+				StartedAt:  &started,
+				FinishedAt: &finished,
+				ExpiresAt:  &expires,
+				Size:       1024,
+			},
+		},
+		{
+			name: "failed backup",
+			job: &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "backup-1",
+					CreationTimestamp: metav1.NewTime(created),
+				},
+				Status: batchv1.JobStatus{
+					StartTime: &metav1.Time{Time: started},
+					Conditions: []batchv1.JobCondition{
+						{
+							Type:               batchv1.JobFailed,
+							Status:             corev1.ConditionTrue,
+							LastTransitionTime: metav1.NewTime(finished),
+							Message:            "Job has reached the specified backoff limit",
+						},
+					},
+				},
+			},
+			result: &jobResult{Error: "connection refused"},
+			want: Backup{
+				ID:         "backup-1",
+				Type:       BackupManual,
+				Status:     OperationFailed,
+				CreatedAt:  created,
+				StartedAt:  &started,
+				FinishedAt: &finished,
+				Error:      "connection refused",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, backupFromJob(tt.job, tt.result))
+		})
+	}
+}
+
+func TestPodResults(t *testing.T) {
+	terminated := func(job, message string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{batchv1.JobNameLabel: job},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}}},
+				},
+			},
+		}
+	}
+
+	got := podResults([]corev1.Pod{
+		terminated("backup-1", `{"snapshot":"abcd","size":42}`),
+		terminated("backup-2", "out of memory"),
+		{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{batchv1.JobNameLabel: "backup-3"}}},
+	})
+
+	assert.Equal(t, map[string]*jobResult{
+		"backup-1": {Snapshot: "abcd", Size: 42},
+		"backup-2": {Error: "out of memory"},
+	}, got)
+}
+
+func TestAPIHandler_JobResult(t *testing.T) {
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "crossplane", Name: "backup-1"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "crossplane",
+			Name:      "backup-1-abcde",
+			Labels:    map[string]string{batchv1.JobNameLabel: "backup-1"},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: `{"snapshot":"abcd","size":42}`}}},
+			},
+		},
+	}
+	cl := fake.NewClientBuilder().WithObjects(job, pod).Build()
+	h := APIHandler{client: cl}
+	rctx := reqcontext.NewReqContext(adminContext(), lager.NewLogger("test"), nil)
+
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(job), job))
+	result, err := h.jobResult(rctx, job)
+	require.NoError(t, err)
+	assert.Equal(t, &jobResult{Snapshot: "abcd", Size: 42}, result)
+
+	require.NoError(t, cl.Delete(context.TODO(), pod))
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(job), job))
+	result, err = h.jobResult(rctx, job)
+	require.NoError(t, err)
+	assert.Equal(t, &jobResult{Snapshot: "abcd", Size: 42}, result, "results must be kept after the pod is gone")
+}
+
+func TestRecoveryWindow(t *testing.T) {
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+
+	tests := []struct {
+		name    string
+		backups []Backup
+		want    *RecoveryWindow
+	}{
+		{
+			name: "no backups",
+		},
+		{
+			name: "starts at the oldest backup within the binlog retention",
+			backups: []Backup{
+				{Status: OperationSucceeded, FinishedAt: at(time.Hour)},
+				{Status: OperationSucceeded, FinishedAt: at(25 * time.Hour)},
+				{Status: OperationFailed, FinishedAt: at(30 * time.Hour)},
+				{Status: OperationSucceeded, FinishedAt: at(80 * time.Hour)},
+			},
+			want: &RecoveryWindow{From: *at(25 * time.Hour), To: now},
+		},
+		{
+			name: "requires a backup within the binlog retention",
+			backups: []Backup{
+				{Status: OperationSucceeded, FinishedAt: at(80 * time.Hour)},
+				{Status: OperationRunning},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, recoveryWindow(tt.backups, 72*time.Hour, now))
+		})
+	}
+}
+
+// newTestBackupHandler returns a handler with backups enabled for the Redis instance 1-1-1,
+// whose jobs run in the crossplane namespace.
+func newTestBackupHandler(objs ...client.Object) (*APIHandler, client.Client) {
+	gvk := schema.GroupVersionKind{Group: "syn.tools", Version: "v1alpha1", Kind: "CompositeRedisInstance"}
+	xr := composite.New(composite.WithGroupVersionKind(gvk))
+	xr.SetName("1-1-1")
+	xr.SetLabels(map[string]string{crossplane.ServiceIDLabel: "1", crossplane.ServiceNameLabel: string(crossplane.RedisService)})
+	xr.SetWriteConnectionSecretToReference(&xrv1.SecretReference{Namespace: "crossplane", Name: "1-1-1"})
+	xr.SetCompositionReference(&corev1.ObjectReference{Name: "1-1"})
+
+	cl := fake.NewClientBuilder().WithObjects(append(objs, xr)...).Build()
+	return &APIHandler{
+		instances: newInstanceCache(&fakeFinder{client: cl, gvk: gvk}, nil, nil),
+		client:    cl,
+		config:    &Config{BackupImage: "backup:latest", BackupSecret: "backup"},
+		log:       lager.NewLogger("test"),
+	}, cl
+}
+
+func TestAPIHandler_DeleteBackup(t *testing.T) {
+	backup := newFinishedBackupJob("backup-1", time.Now(), nil)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "crossplane",
+			Name:      "backup-1-abcde",
+			Labels:    map[string]string{batchv1.JobNameLabel: "backup-1"},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: `{"snapshot":"abcd"}`}}},
+			},
+		},
+	}
+	failed := newFinishedBackupJob("backup-2", time.Now(), nil)
+	failed.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	h, cl := newTestBackupHandler(backup, pod, failed)
+	rctx := reqcontext.NewReqContext(adminContext(), lager.NewLogger("test"), nil)
+
+	require.NoError(t, h.DeleteBackup(rctx, "1-1-1", "backup-1"))
+	err := cl.Get(context.TODO(), client.ObjectKeyFromObject(backup), &batchv1.Job{})
+	assert.True(t, apierrors.IsNotFound(err), "backup job must be deleted")
+	prune := &batchv1.Job{}
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: "prune-backup-1"}, prune))
+	assert.Contains(t, prune.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "SNAPSHOT", Value: "abcd"})
+
+	require.NoError(t, h.DeleteBackup(rctx, "1-1-1", "backup-2"))
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: "prune-backup-2"}, prune),
+		"backups without snapshot must be pruned as well")
+	assert.Contains(t, prune.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "BACKUP_ID", Value: "backup-2"})
+
+	assert.Equal(t, errBackupDoesNotExist, h.DeleteBackup(rctx, "1-1-1", "backup-1"))
+}
+
+func TestAPIHandler_DeleteBackup_InUse(t *testing.T) {
+	backup := newFinishedBackupJob("backup-1", time.Now(), nil)
+	restore := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "crossplane",
+			Name:      "restore-1-1-1",
+			Labels:    map[string]string{OperationLabel: operationRestore, BackupIDLabel: "backup-1"},
+		},
+		Status: batchv1.JobStatus{Active: 1},
+	}
+	h, cl := newTestBackupHandler(backup, restore)
+	rctx := reqcontext.NewReqContext(adminContext(), lager.NewLogger("test"), nil)
+
+	assert.Equal(t, errBackupInUse, h.DeleteBackup(rctx, "1-1-1", "backup-1"))
+	assert.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(backup), &batchv1.Job{}))
+	err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: "prune-backup-1"}, &batchv1.Job{})
+	assert.True(t, apierrors.IsNotFound(err), "backups in use must not be pruned")
+}
+
+func TestAPIHandler_DeleteBackup_Running(t *testing.T) {
+	backup := newFinishedBackupJob("backup-1", time.Now(), nil)
+	backup.Status = batchv1.JobStatus{Active: 1}
+	h, cl := newTestBackupHandler(backup)
+	rctx := reqcontext.NewReqContext(adminContext(), lager.NewLogger("test"), nil)
+
+	assert.Equal(t, errBackupRunning, h.DeleteBackup(rctx, "1-1-1", "backup-1"))
+	assert.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(backup), &batchv1.Job{}))
+	err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: "prune-backup-1"}, &batchv1.Job{})
+	assert.True(t, apierrors.IsNotFound(err), "running backups must not be pruned")
+}
+
+func TestRestoreFromJob(t *testing.T) {
+	created := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	finished := created.Add(time.Minute)
+	labels := map[string]string{BackupIDLabel: "backup-1", crossplane.InstanceIDLabel: "1-1-1"}
+
+	tests := []struct {
+		name   string
+		status batchv1.JobStatus
+		result *jobResult
+		want   Restore
+	}{
+		{
+			name: "pending restore",
+			want: Restore{ID: "restore-1", BackupID: "backup-1", InstanceID: "1-1-1", Status: OperationPending, CreatedAt: created},
+		},
+		{
+			name:   "running restore",
+			status: batchv1.JobStatus{StartTime: &metav1.Time{Time: created}, Active: 1},
+			want:   Restore{ID: "restore-1", BackupID: "backup-1", InstanceID: "1-1-1", Status: OperationRunning, CreatedAt: created, StartedAt: &created},
+		},
+		{
+			name: "succeeded restore",
+			status: batchv1.JobStatus{
+				StartTime:      &metav1.Time{Time: created},
+				CompletionTime: &metav1.Time{Time: finished},
+				Conditions:     []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}},
+			},
+			want: Restore{ID: "restore-1", BackupID: "backup-1", InstanceID: "1-1-1", Status: OperationSucceeded, CreatedAt: created, StartedAt: &created, FinishedAt: &finished},
+		},
+		{
+			name: "failed restore",
+			status: batchv1.JobStatus{
+				StartTime: &metav1.Time{Time: created},
+				Conditions: []batchv1.JobCondition{{
+					Type:               batchv1.JobFailed,
+					Status:             corev1.ConditionTrue,
+					LastTransitionTime: metav1.NewTime(finished),
+					Message:            "Job has reached the specified backoff limit",
+				}},
+			},
+			result: &jobResult{Error: "snapshot not found"},
+			want: Restore{
+				ID: "restore-1", BackupID: "backup-1", InstanceID: "1-1-1", Status: OperationFailed,
+				CreatedAt: created, StartedAt: &created, FinishedAt: &finished, Error: "snapshot not found",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Labels: labels, CreationTimestamp: metav1.NewTime(created)},
+				Status:     tt.status,
+			}
+			assert.Equal(t, tt.want, restoreFromJob(job, tt.result))
+		})
+	}
+}
+
+func TestAPIHandler_RestoreBackup_InPlace(t *testing.T) {
+	backup := newFinishedBackupJob("backup-1", time.Now(), map[string]string{ResultAnnotation: `{"snapshot":"abcd"}`})
+	failed := newFinishedBackupJob("backup-2", time.Now(), nil)
+	failed.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	h, cl := newTestBackupHandler(backup, failed)
+	rctx := reqcontext.NewReqContext(adminContext(), lager.NewLogger("test"), nil)
+
+	_, err := h.RestoreBackup(rctx, "1-1-1", "backup-2", &RestoreRequest{})
+	assert.Equal(t, errBackupNotRestorable, err)
+
+	restore, err := h.RestoreBackup(rctx, "1-1-1", "backup-1", &RestoreRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, OperationPending, restore.Status)
+	assert.Equal(t, "1-1-1", restore.InstanceID)
+	job := &batchv1.Job{}
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: restore.ID}, job))
+	assert.Contains(t, job.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "SNAPSHOT", Value: "abcd"})
+
+	_, err = h.RestoreBackup(rctx, "1-1-1", "backup-1", &RestoreRequest{})
+	assert.Equal(t, errRestoreInProgress, err, "only one restore may run at a time")
+	assert.Equal(t, errBackupInUse, h.DeleteBackup(rctx, "1-1-1", "backup-1"))
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	require.NoError(t, cl.Status().Update(context.TODO(), job))
+	status, err := h.RestoreStatus(rctx, "1-1-1", "backup-1", restore.ID)
+	require.NoError(t, err)
+	assert.Equal(t, OperationSucceeded, status.Status)
+
+	_, err = h.RestoreStatus(rctx, "1-1-1", "backup-1", "restore-2")
+	assert.Equal(t, errRestoreDoesNotExist, err)
+}
+
+func newTestPlan(name, serviceID, size string) *unstructured.Unstructured {
+	plan := newComposition(name)
+	plan.SetLabels(map[string]string{crossplane.ServiceIDLabel: serviceID, crossplane.PlanNameLabel: size})
+	return plan
+}
+
+func TestAPIHandler_RestoreBackup_TargetInstance(t *testing.T) {
+	backup := newFinishedBackupJob("backup-1", time.Now(), map[string]string{ResultAnnotation: `{"snapshot":"abcd"}`})
+	gvk := schema.GroupVersionKind{Group: "syn.tools", Version: "v1alpha1", Kind: "CompositeRedisInstance"}
+	newTarget := func(name, serviceID, planID string) *composite.Unstructured {
+		xr := composite.New(composite.WithGroupVersionKind(gvk))
+		xr.SetName(name)
+		xr.SetLabels(map[string]string{crossplane.ServiceIDLabel: serviceID, crossplane.ServiceNameLabel: string(crossplane.RedisService)})
+		xr.SetWriteConnectionSecretToReference(&xrv1.SecretReference{Namespace: "crossplane", Name: name})
+		xr.SetCompositionReference(&corev1.ObjectReference{Name: planID})
+		return xr
+	}
+	h, cl := newTestBackupHandler(backup,
+		newTestPlan("1-0", "1", "xsmall"), newTestPlan("1-1", "1", "small"), newTestPlan("1-3", "1", "large"),
+		newTarget("1-1-2", "1", "1-3"), newTarget("1-1-3", "1", "1-0"), newTarget("2-1-1", "2", "2-1"))
+	h.config.PlanUpdateSizeRule = "xsmall>small|small>large"
+	rctx := reqcontext.NewReqContext(adminContext(), lager.NewLogger("test"), nil)
+
+	for _, target := range []string{"", "1-1-1", "1-1-3", "2-1-1", "1-1-9"} {
+		_, err := h.RestoreBackup(rctx, "1-1-1", "backup-1", &RestoreRequest{Mode: RestoreNewInstance, TargetInstanceID: target})
+		var failure *apiresponses.FailureResponse
+		require.ErrorAs(t, err, &failure, target)
+		assert.Equal(t, http.StatusUnprocessableEntity, failure.ValidatedStatusCode(nil), target)
+	}
+
+	restore, err := h.RestoreBackup(rctx, "1-1-1", "backup-1", &RestoreRequest{Mode: RestoreNewInstance, TargetInstanceID: "1-1-2"})
+	require.NoError(t, err)
+	assert.Equal(t, "1-1-2", restore.InstanceID)
+	job := &batchv1.Job{}
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: restore.ID}, job))
+
+	_, err = h.RestoreBackup(rctx, "1-1-1", "backup-1", &RestoreRequest{Mode: RestoreNewInstance, TargetInstanceID: "1-1-2"})
+	assert.Equal(t, errRestoreInProgress, err)
+}
+
+func TestSizeReachable(t *testing.T) {
+	rule := "xsmall>small|small>medium|medium>large"
+	assert.True(t, sizeReachable(rule, "xsmall", "large"))
+	assert.True(t, sizeReachable(rule, "small", "medium"))
+	assert.False(t, sizeReachable(rule, "large", "small"))
+	assert.False(t, sizeReachable("", "small", "large"))
+}
+
+func TestBackupName(t *testing.T) {
+	now := time.Now()
+	id := "8b2a6fd4-0c4d-4f9e-a3a7-4b3c0d7e1f52"
+	name := backupName(id, now)
+	assert.NotEqual(t, name, backupName(id, now), "backups requested at the same time must not collide")
+	assert.LessOrEqual(t, len(newPruneJob(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name}}, "").Name), 63)
+}
@@ -0,0 +1,233 @@
+package custom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi/v8/domain"
+	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PlatformAnnotation is the platform an instance was provisioned by.
+	PlatformAnnotation = crossplane.SynToolsBase + "/platform"
+	// OrganizationAnnotation is the organization an instance was provisioned in.
+	OrganizationAnnotation = crossplane.SynToolsBase + "/organization"
+	// SpaceAnnotation is the space an instance was provisioned in.
+	SpaceAnnotation = crossplane.SynToolsBase + "/space"
+)
+
+var errPlanDeprecated = apiresponses.NewFailureResponseBuilder(
+	errors.New("plan is deprecated and can't be used for new instances"),
+	http.StatusBadRequest,
+	"plan-deprecated").
+	WithErrorKey("PlanDeprecated").
+	Build()
+
+// Broker wraps the open service broker API implementation to hide deprecated plans from the catalog
+// and to prevent them from being used by new instances. Existing instances of deprecated plans keep working.
+// It also adds the parameter schemas of the plans to the catalog and records the organization and space of new instances.
+type Broker struct {
+	domain.ServiceBroker
+	client client.Client
+	log    lager.Logger
+}
+
+// NewBroker wraps the service broker.
+func NewBroker(sb domain.ServiceBroker, cl client.Client, log lager.Logger) *Broker {
+	return &Broker{sb, cl, log}
+}
+
+// Services returns the catalog without deprecated plans and adds the parameter schemas of the plans.
+func (b Broker) Services(ctx context.Context) ([]domain.Service, error) {
+	services, err := b.ServiceBroker.Services(ctx)
+	if err != nil {
+		return nil, err
+	}
+	compositions := newList(compositionGVK)
+	if err := b.client.List(ctx, compositions, client.HasLabels{crossplane.ServiceIDLabel}); err != nil {
+		return nil, err
+	}
+	deprecated := map[string]bool{}
+	schemas := map[string]*domain.ServiceSchemas{}
+	for _, c := range compositions.Items {
+		if c.GetLabels()[DeprecatedLabel] == "true" {
+			deprecated[c.GetName()] = true
+		}
+		if a, ok := c.GetAnnotations()[SchemasAnnotation]; ok {
+			s := &domain.ServiceSchemas{}
+			if err := json.Unmarshal([]byte(a), s); err != nil {
+				return nil, fmt.Errorf("invalid schemas of plan %q: %w", c.GetName(), err)
+			}
+			schemas[c.GetName()] = s
+		}
+	}
+
+	for i := range services {
+		plans := make([]domain.ServicePlan, 0, len(services[i].Plans))
+		for _, p := range services[i].Plans {
+			if deprecated[p.ID] {
+				continue
+			}
+			if s, ok := schemas[p.ID]; ok && p.Schemas == nil {
+				p.Schemas = s
+			}
+			plans = append(plans, p)
+		}
+		services[i].Plans = plans
+	}
+	return services, nil
+}
+
+// Provision refuses to provision instances of deprecated plans.
+// The platform, organization and space the instance is provisioned in are recorded on its composite.
+// Failing to record them is logged but doesn't fail the provisioning, as the instance exists already.
+// Update backfills them.
+func (b Broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (domain.ProvisionedServiceSpec, error) {
+	deprecated, err := b.deprecatedPlans(ctx)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	if deprecated[details.PlanID] {
+		return domain.ProvisionedServiceSpec{}, errPlanDeprecated
+	}
+	spec, err := b.ServiceBroker.Provision(ctx, instanceID, details, asyncAllowed)
+	if err != nil {
+		return spec, err
+	}
+	if err := b.recordProvisionContext(ctx, instanceID, details.PlanID, provisionContext(ctx, details)); err != nil {
+		b.log.Error("record-provision-context", err, lager.Data{"instance-id": instanceID})
+	}
+	return spec, nil
+}
+
+// recordProvisionContext annotates the composite of the instance with the platform, organization and space it was provisioned in.
+// Annotations the composite has already are kept. The composite is found through the composition of the plan,
+// which references its kind.
+func (b Broker) recordProvisionContext(ctx context.Context, instanceID, planID string, pc map[string]string) error {
+	if len(pc) == 0 {
+		return nil
+	}
+
+	comp := newComposition(planID)
+	if err := b.client.Get(ctx, client.ObjectKeyFromObject(comp), comp); err != nil {
+		return err
+	}
+	apiVersion, _, _ := unstructured.NestedString(comp.Object, "spec", "compositeTypeRef", "apiVersion")
+	xr := &unstructured.Unstructured{}
+	xr.SetAPIVersion(apiVersion)
+	xr.SetKind(compositionCompositeKind(comp))
+	xr.SetName(instanceID)
+	if err := b.client.Get(ctx, client.ObjectKeyFromObject(xr), xr); err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(xr.DeepCopy())
+	annotations := xr.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	changed := false
+	for k, v := range pc {
+		if _, ok := annotations[k]; !ok {
+			annotations[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	xr.SetAnnotations(annotations)
+	return b.client.Patch(ctx, xr, patch)
+}
+
+// provisionContext returns the annotations recording the platform, organization and space of the provision request.
+// Platforms send them as fields of the request or, as of OSB API 2.15, in its context.
+// Without a context the platform is taken from the originating identity.
+func provisionContext(ctx context.Context, details domain.ProvisionDetails) map[string]string {
+	return requestContext(ctx, details.RawContext, details.OrganizationGUID, details.SpaceGUID)
+}
+
+// requestContext returns the annotations recording the platform, organization and space of a request of the platform,
+// the organization and space fields take precedence over the context.
+func requestContext(ctx context.Context, rawContext json.RawMessage, organizationGUID, spaceGUID string) map[string]string {
+	var rc struct {
+		Platform         string `json:"platform"`
+		OrganizationGUID string `json:"organization_guid"`
+		SpaceGUID        string `json:"space_guid"`
+	}
+	if len(rawContext) > 0 {
+		_ = json.Unmarshal(rawContext, &rc)
+	}
+	if organizationGUID != "" {
+		rc.OrganizationGUID = organizationGUID
+	}
+	if spaceGUID != "" {
+		rc.SpaceGUID = spaceGUID
+	}
+
+	if rc.Platform == "" {
+		if identity, err := originatingIdentity(ctx); err == nil && identity != nil {
+			rc.Platform = identity.Platform
+		}
+	}
+
+	pc := map[string]string{}
+	if rc.Platform != "" {
+		pc[PlatformAnnotation] = rc.Platform
+	}
+	if rc.OrganizationGUID != "" {
+		pc[OrganizationAnnotation] = rc.OrganizationGUID
+	}
+	if rc.SpaceGUID != "" {
+		pc[SpaceAnnotation] = rc.SpaceGUID
+	}
+	return pc
+}
+
+// Update refuses to change the plan of an instance to a deprecated plan.
+// Instances provisioned before their context was recorded get it backfilled from the context of the update request,
+// which is required to access them with tenant scoped tokens on the custom API.
+func (b Broker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	if details.PlanID != "" && details.PlanID != details.PreviousValues.PlanID {
+		deprecated, err := b.deprecatedPlans(ctx)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+		if deprecated[details.PlanID] {
+			return domain.UpdateServiceSpec{}, errPlanDeprecated
+		}
+	}
+	spec, err := b.ServiceBroker.Update(ctx, instanceID, details, asyncAllowed)
+	if err != nil {
+		return spec, err
+	}
+	planID := details.PreviousValues.PlanID
+	if planID == "" {
+		planID = details.PlanID
+	}
+	if err := b.recordProvisionContext(ctx, instanceID, planID, requestContext(ctx, details.RawContext, "", "")); err != nil {
+		b.log.Error("backfill-provision-context", err, lager.Data{"instance-id": instanceID})
+	}
+	return spec, nil
+}
+
+// deprecatedPlans returns the IDs of all deprecated plans.
+func (b Broker) deprecatedPlans(ctx context.Context) (map[string]bool, error) {
+	compositions := newList(compositionGVK)
+	if err := b.client.List(ctx, compositions, client.MatchingLabels{DeprecatedLabel: "true"}); err != nil {
+		return nil, err
+	}
+	deprecated := make(map[string]bool, len(compositions.Items))
+	for _, c := range compositions.Items {
+		deprecated[c.GetName()] = true
+	}
+	return deprecated, nil
+}
@@ -0,0 +1,154 @@
+package custom
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi/v8/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+type testBroker struct {
+	domain.ServiceBroker
+	client      client.Client
+	provisioned []string
+}
+
+func (b *testBroker) Services(ctx context.Context) ([]domain.Service, error) {
+	return []domain.Service{
+		{ID: "1", Plans: []domain.ServicePlan{{ID: "1-1"}, {ID: "1-2"}}},
+	}, nil
+}
+
+func (b *testBroker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (domain.ProvisionedServiceSpec, error) {
+	b.provisioned = append(b.provisioned, instanceID)
+	xr := &unstructured.Unstructured{}
+	xr.SetAPIVersion("syn.tools/v1alpha1")
+	xr.SetKind("CompositeRedisInstance")
+	xr.SetName(instanceID)
+	return domain.ProvisionedServiceSpec{IsAsync: true}, b.client.Create(ctx, xr)
+}
+
+func (b *testBroker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	return domain.UpdateServiceSpec{IsAsync: true}, nil
+}
+
+func newTestBroker(funcs interceptor.Funcs) (*Broker, *testBroker) {
+	plan := newComposition("1-1")
+	plan.SetLabels(map[string]string{crossplane.ServiceIDLabel: "1"})
+	plan.SetAnnotations(map[string]string{SchemasAnnotation: `{"service_instance":{"create":{"parameters":{"type":"object"}}}}`})
+	plan.Object["spec"] = map[string]interface{}{
+		"compositeTypeRef": map[string]interface{}{"apiVersion": "syn.tools/v1alpha1", "kind": "CompositeRedisInstance"},
+	}
+	deprecated := newComposition("1-2")
+	deprecated.SetLabels(map[string]string{crossplane.ServiceIDLabel: "1", DeprecatedLabel: "true"})
+	cl := fake.NewClientBuilder().WithObjects([]client.Object{plan, deprecated}...).WithInterceptorFuncs(funcs).Build()
+
+	tb := &testBroker{client: cl}
+	return NewBroker(tb, cl, lager.NewLogger("test")), tb
+}
+
+func TestBroker_Services(t *testing.T) {
+	b, _ := newTestBroker(interceptor.Funcs{})
+
+	services, err := b.Services(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Service{
+		{ID: "1", Plans: []domain.ServicePlan{{
+			ID: "1-1",
+			Schemas: &domain.ServiceSchemas{Instance: domain.ServiceInstanceSchema{
+				Create: domain.Schema{Parameters: map[string]interface{}{"type": "object"}},
+			}},
+		}}},
+	}, services)
+}
+
+func TestBroker_Provision(t *testing.T) {
+	b, tb := newTestBroker(interceptor.Funcs{})
+
+	_, err := b.Provision(context.TODO(), "1-2-1", domain.ProvisionDetails{PlanID: "1-2"}, true)
+	assert.Equal(t, errPlanDeprecated, err)
+
+	_, err = b.Provision(context.TODO(), "1-1-1", domain.ProvisionDetails{PlanID: "1-1"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1-1-1"}, tb.provisioned)
+
+	_, err = b.Provision(context.TODO(), "1-1-2", domain.ProvisionDetails{
+		PlanID:     "1-1",
+		RawContext: []byte(`{"platform":"cloudfoundry","organization_guid":"org-1","space_guid":"space-1"}`),
+	}, true)
+	require.NoError(t, err)
+	xr := &unstructured.Unstructured{}
+	xr.SetAPIVersion("syn.tools/v1alpha1")
+	xr.SetKind("CompositeRedisInstance")
+	require.NoError(t, tb.client.Get(context.TODO(), client.ObjectKey{Name: "1-1-2"}, xr))
+	assert.Equal(t, map[string]string{
+		PlatformAnnotation:     "cloudfoundry",
+		OrganizationAnnotation: "org-1",
+		SpaceAnnotation:        "space-1",
+	}, xr.GetAnnotations())
+}
+
+func TestBroker_Provision_RecordContextFailure(t *testing.T) {
+	b, tb := newTestBroker(interceptor.Funcs{
+		Patch: func(context.Context, client.WithWatch, client.Object, client.Patch, ...client.PatchOption) error {
+			return errors.New("conflict")
+		},
+	})
+
+	spec, err := b.Provision(context.TODO(), "1-1-1", domain.ProvisionDetails{
+		PlanID:     "1-1",
+		RawContext: []byte(`{"platform":"cloudfoundry","organization_guid":"org-1"}`),
+	}, true)
+	require.NoError(t, err, "provisioned instances must not be reported as failed")
+	assert.True(t, spec.IsAsync)
+	assert.Equal(t, []string{"1-1-1"}, tb.provisioned)
+}
+
+func TestBroker_Update(t *testing.T) {
+	b, _ := newTestBroker(interceptor.Funcs{})
+
+	_, err := b.Update(context.TODO(), "1-1-1", domain.UpdateDetails{
+		PlanID:         "1-2",
+		PreviousValues: domain.PreviousValues{PlanID: "1-1"},
+	}, true)
+	assert.Equal(t, errPlanDeprecated, err)
+
+	_, err = b.Update(context.TODO(), "1-2-1", domain.UpdateDetails{
+		PlanID:         "1-2",
+		PreviousValues: domain.PreviousValues{PlanID: "1-2"},
+	}, true)
+	assert.NoError(t, err, "instances of deprecated plans must keep working")
+}
+
+func TestBroker_Update_BackfillContext(t *testing.T) {
+	b, tb := newTestBroker(interceptor.Funcs{})
+	_, err := b.Provision(context.TODO(), "1-1-1", domain.ProvisionDetails{PlanID: "1-1"}, true)
+	require.NoError(t, err)
+
+	for _, org := range []string{"org-1", "org-2"} {
+		_, err = b.Update(context.TODO(), "1-1-1", domain.UpdateDetails{
+			PreviousValues: domain.PreviousValues{PlanID: "1-1"},
+			RawContext:     []byte(`{"platform":"cloudfoundry","organization_guid":"` + org + `","space_guid":"space-1"}`),
+		}, true)
+		require.NoError(t, err)
+	}
+
+	xr := &unstructured.Unstructured{}
+	xr.SetAPIVersion("syn.tools/v1alpha1")
+	xr.SetKind("CompositeRedisInstance")
+	require.NoError(t, tb.client.Get(context.TODO(), client.ObjectKey{Name: "1-1-1"}, xr))
+	assert.Equal(t, map[string]string{
+		PlatformAnnotation:     "cloudfoundry",
+		OrganizationAnnotation: "org-1",
+		SpaceAnnotation:        "space-1",
+	}, xr.GetAnnotations(), "recorded context must not be changed by later requests")
+}
@@ -0,0 +1,213 @@
+package custom
+
+import (
+	"context"
+	"sync"
+
+	"github.com/crossplane/crossplane-runtime/pkg/resource/unstructured/composite"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	cacheKindInstance          = "instance"
+	cacheKindConnectionDetails = "connection-details"
+)
+
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swisscom_service_broker_cache_hits_total",
+		Help: "Number of instance and connection detail lookups of the custom API served from the cache.",
+	}, []string{"kind"})
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swisscom_service_broker_cache_misses_total",
+		Help: "Number of instance and connection detail lookups of the custom API which had to query the API server.",
+	}, []string{"kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(cacheHits, cacheMisses)
+}
+
+// CacheOptions returns the options of the cache passed to NewAPIHandler and RecordJobResults.
+// Secrets and pods are only watched in the namespace connection secrets and operation jobs are in,
+// pods only if they belong to an operation. Composites are cluster scoped and not restricted.
+func CacheOptions(namespace string) (cache.Options, error) {
+	operationPods, err := labels.NewRequirement(OperationLabel, selection.Exists, nil)
+	if err != nil {
+		return cache.Options{}, err
+	}
+	return cache.Options{
+		DefaultNamespaces: map[string]cache.Config{namespace: {}},
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Pod{}: {Label: labels.NewSelector().Add(*operationPods)},
+		},
+	}, nil
+}
+
+// informerSource returns the informers of object types, which is implemented by cache.Cache.
+type informerSource interface {
+	GetInformer(ctx context.Context, obj client.Object, opts ...cache.InformerGetOption) (cache.Informer, error)
+}
+
+// instanceFinder looks up instances and their connection details, which is implemented by crossplane.Crossplane.
+type instanceFinder interface {
+	FindInstanceWithoutPlan(rctx *reqcontext.ReqContext, id string) (*crossplane.Instance, *crossplane.Plan, bool, error)
+	GetConnectionDetails(ctx context.Context, xr *composite.Unstructured) (*corev1.Secret, error)
+}
+
+// instanceCache serves instance lookups and connection details from informers, so polling the custom API
+// doesn't result in requests to the API server.
+//
+// Instances are looked up through crossplane once and kept as long as the informer of their composite
+// reports the same resource version. Updated and deleted composites are looked up again, and evicted
+// as soon as the informer reports the change.
+// Connection secrets are read from the informer directly, which keeps up with rotated secrets.
+// Without a reader every lookup goes to crossplane.
+type instanceCache struct {
+	finder    instanceFinder
+	reader    client.Reader
+	informers informerSource
+
+	mu        sync.Mutex
+	instances map[string]*crossplane.Instance
+	watched   map[schema.GroupVersionKind]bool
+}
+
+func newInstanceCache(finder instanceFinder, reader client.Reader, informers informerSource) *instanceCache {
+	return &instanceCache{
+		finder:    finder,
+		reader:    reader,
+		informers: informers,
+		instances: map[string]*crossplane.Instance{},
+		watched:   map[schema.GroupVersionKind]bool{},
+	}
+}
+
+// findInstance returns the instance with the given ID and whether it exists.
+func (c *instanceCache) findInstance(rctx *reqcontext.ReqContext, id string) (*crossplane.Instance, bool, error) {
+	if c.reader == nil {
+		instance, _, exists, err := c.finder.FindInstanceWithoutPlan(rctx, id)
+		return instance, exists, err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.instances[id]
+	c.mu.Unlock()
+	if ok && c.current(rctx.Context, cached) {
+		cacheHits.WithLabelValues(cacheKindInstance).Inc()
+		return copyInstance(cached), true, nil
+	}
+
+	cacheMisses.WithLabelValues(cacheKindInstance).Inc()
+	instance, _, exists, err := c.finder.FindInstanceWithoutPlan(rctx, id)
+	if err != nil || !exists {
+		c.evict(id, "")
+		return instance, exists, err
+	}
+	if err := c.watch(rctx.Context, instance.Composite.GetObjectKind().GroupVersionKind()); err != nil {
+		rctx.Logger.Error("watch-composites", err)
+		return instance, true, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances[id] = copyInstance(instance)
+	return instance, true, nil
+}
+
+// watch evicts cached instances when the informer of their composite type reports them updated or deleted.
+func (c *instanceCache) watch(ctx context.Context, gvk schema.GroupVersionKind) error {
+	if c.informers == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.watched[gvk] {
+		return nil
+	}
+	xr := &unstructured.Unstructured{}
+	xr.SetGroupVersionKind(gvk)
+	informer, err := c.informers.GetInformer(ctx, xr)
+	if err != nil {
+		return err
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			if o, ok := obj.(client.Object); ok {
+				c.evict(o.GetName(), o.GetResourceVersion())
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if d, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = d.Obj
+			}
+			if o, ok := obj.(client.Object); ok {
+				c.evict(o.GetName(), "")
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	c.watched[gvk] = true
+	return nil
+}
+
+// evict removes the cached instance unless it has the given resource version.
+func (c *instanceCache) evict(id, resourceVersion string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.instances[id]; ok && cached.Composite.GetResourceVersion() != resourceVersion {
+		delete(c.instances, id)
+	}
+}
+
+// current returns true if the informer has the same version of the composite of the instance.
+// The informer of the composite type is started by the first lookup.
+func (c *instanceCache) current(ctx context.Context, instance *crossplane.Instance) bool {
+	xr := &unstructured.Unstructured{}
+	xr.SetGroupVersionKind(instance.Composite.GetObjectKind().GroupVersionKind())
+	if err := c.reader.Get(ctx, client.ObjectKeyFromObject(instance.Composite), xr); err != nil {
+		return false
+	}
+	return xr.GetResourceVersion() == instance.Composite.GetResourceVersion()
+}
+
+// connectionDetails returns the connection secret of the composite.
+func (c *instanceCache) connectionDetails(ctx context.Context, xr *composite.Unstructured) (*corev1.Secret, error) {
+	ref := xr.GetWriteConnectionSecretToReference()
+	if c.reader == nil || ref == nil {
+		return c.finder.GetConnectionDetails(ctx, xr)
+	}
+
+	secret := &corev1.Secret{}
+	err := c.reader.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, secret)
+	if err == nil {
+		cacheHits.WithLabelValues(cacheKindConnectionDetails).Inc()
+		return secret, nil
+	}
+	// The secret might not have reached the informer yet, crossplane reports whether it really doesn't exist.
+	cacheMisses.WithLabelValues(cacheKindConnectionDetails).Inc()
+	return c.finder.GetConnectionDetails(ctx, xr)
+}
+
+// copyInstance returns a deep copy of the instance, which allows callers to modify the instances they get.
+func copyInstance(i *crossplane.Instance) *crossplane.Instance {
+	c := *i
+	c.Composite = &composite.Unstructured{Unstructured: *i.Composite.Unstructured.DeepCopy()}
+	if i.Labels != nil {
+		l := *i.Labels
+		c.Labels = &l
+	}
+	return &c
+}
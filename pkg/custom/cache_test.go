@@ -0,0 +1,171 @@
+package custom
+
+import (
+	"context"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/crossplane/crossplane-runtime/pkg/resource/unstructured/composite"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeFinder looks up instances and connection details in a client, counting the lookups.
+// Instances are of the service named by their labels, Redis by default.
+type fakeFinder struct {
+	client  client.Client
+	gvk     schema.GroupVersionKind
+	lookups int
+}
+
+func (f *fakeFinder) FindInstanceWithoutPlan(rctx *reqcontext.ReqContext, id string) (*crossplane.Instance, *crossplane.Plan, bool, error) {
+	f.lookups++
+	xr := composite.New(composite.WithGroupVersionKind(f.gvk))
+	if err := f.client.Get(rctx.Context, client.ObjectKey{Name: id}, xr); err != nil {
+		return nil, nil, false, client.IgnoreNotFound(err)
+	}
+	labels := &crossplane.Labels{
+		ServiceID:   xr.GetLabels()[crossplane.ServiceIDLabel],
+		ServiceName: crossplane.ServiceName(xr.GetLabels()[crossplane.ServiceNameLabel]),
+		InstanceID:  id,
+	}
+	if labels.ServiceName == "" {
+		labels.ServiceName = crossplane.RedisService
+	}
+	return &crossplane.Instance{Composite: xr, Labels: labels}, nil, true, nil
+}
+
+func (f *fakeFinder) GetConnectionDetails(ctx context.Context, xr *composite.Unstructured) (*corev1.Secret, error) {
+	f.lookups++
+	ref := xr.GetWriteConnectionSecretToReference()
+	s := &corev1.Secret{}
+	return s, f.client.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, s)
+}
+
+func TestInstanceCache(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "syn.tools", Version: "v1alpha1", Kind: "CompositeRedisInstance"}
+	xr := composite.New(composite.WithGroupVersionKind(gvk))
+	xr.SetName("1-1-1")
+	xr.SetWriteConnectionSecretToReference(&xrv1.SecretReference{Namespace: "crossplane", Name: "1-1-1"})
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "crossplane", Name: "1-1-1"},
+		Data:       map[string][]byte{"password": []byte("secret")},
+	}
+	cl := fake.NewClientBuilder().WithObjects(xr, secret).Build()
+	finder := &fakeFinder{client: cl, gvk: gvk}
+	c := newInstanceCache(finder, cl, nil)
+	rctx := reqcontext.NewReqContext(context.Background(), lager.NewLogger("test"), nil)
+
+	hits := testutil.ToFloat64(cacheHits.WithLabelValues(cacheKindInstance))
+	misses := testutil.ToFloat64(cacheMisses.WithLabelValues(cacheKindInstance))
+
+	instance, exists, err := c.findInstance(rctx, "1-1-1")
+	require.NoError(t, err)
+	require.True(t, exists)
+	instance.Labels.ServiceName = crossplane.MariaDBService
+
+	instance, exists, err = c.findInstance(rctx, "1-1-1")
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, crossplane.RedisService, instance.Labels.ServiceName, "cached instances must not be modified by callers")
+	assert.Equal(t, 1, finder.lookups)
+	assert.Equal(t, hits+1, testutil.ToFloat64(cacheHits.WithLabelValues(cacheKindInstance)))
+	assert.Equal(t, misses+1, testutil.ToFloat64(cacheMisses.WithLabelValues(cacheKindInstance)))
+
+	xr.SetLabels(map[string]string{"changed": "true"})
+	require.NoError(t, cl.Update(rctx.Context, xr))
+	instance, _, err = c.findInstance(rctx, "1-1-1")
+	require.NoError(t, err)
+	assert.Equal(t, "true", instance.Composite.GetLabels()["changed"], "updated instances must be looked up again")
+	assert.Equal(t, 2, finder.lookups)
+
+	secret.Data["password"] = []byte("rotated")
+	require.NoError(t, cl.Update(rctx.Context, secret))
+	s, err := c.connectionDetails(rctx.Context, instance.Composite)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", string(s.Data["password"]))
+	assert.Equal(t, 2, finder.lookups)
+
+	require.NoError(t, cl.Delete(rctx.Context, xr))
+	_, exists, err = c.findInstance(rctx, "1-1-1")
+	require.NoError(t, err)
+	assert.False(t, exists, "deleted instances must not be served from the cache")
+}
+
+// fakeInformers returns informers which record the event handlers added to them.
+type fakeInformers struct {
+	handlers []toolscache.ResourceEventHandler
+}
+
+func (f *fakeInformers) GetInformer(context.Context, client.Object, ...cache.InformerGetOption) (cache.Informer, error) {
+	return &fakeInformer{informers: f}, nil
+}
+
+type fakeInformer struct {
+	cache.Informer
+	informers *fakeInformers
+}
+
+func (f *fakeInformer) AddEventHandler(h toolscache.ResourceEventHandler) (toolscache.ResourceEventHandlerRegistration, error) {
+	f.informers.handlers = append(f.informers.handlers, h)
+	return nil, nil
+}
+
+func TestInstanceCache_Evict(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "syn.tools", Version: "v1alpha1", Kind: "CompositeRedisInstance"}
+	var objs []client.Object
+	for _, id := range []string{"1-1-1", "2-2-2"} {
+		xr := composite.New(composite.WithGroupVersionKind(gvk))
+		xr.SetName(id)
+		objs = append(objs, xr)
+	}
+	cl := fake.NewClientBuilder().WithObjects(objs...).Build()
+	informers := &fakeInformers{}
+	c := newInstanceCache(&fakeFinder{client: cl, gvk: gvk}, cl, informers)
+	rctx := reqcontext.NewReqContext(context.Background(), lager.NewLogger("test"), nil)
+
+	for _, id := range []string{"1-1-1", "2-2-2"} {
+		_, exists, err := c.findInstance(rctx, id)
+		require.NoError(t, err)
+		require.True(t, exists)
+	}
+	require.Len(t, informers.handlers, 1, "the composite type must only be watched once")
+	require.Len(t, c.instances, 2)
+	h := informers.handlers[0]
+
+	current := objs[0].(*composite.Unstructured).DeepCopy()
+	h.OnUpdate(current, current)
+	assert.Len(t, c.instances, 2, "instances must be kept as long as their version is current")
+
+	updated := current.DeepCopy()
+	updated.SetResourceVersion("1000")
+	h.OnUpdate(current, updated)
+	assert.NotContains(t, c.instances, "1-1-1", "updated instances must be evicted")
+
+	h.OnDelete(toolscache.DeletedFinalStateUnknown{Key: "2-2-2", Obj: objs[1]})
+	assert.Empty(t, c.instances, "deleted instances must be evicted")
+}
+
+func TestCacheOptions(t *testing.T) {
+	opts, err := CacheOptions("crossplane")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]cache.Config{"crossplane": {}}, opts.DefaultNamespaces)
+	for obj, o := range opts.ByObject {
+		require.IsType(t, &corev1.Pod{}, obj)
+		assert.True(t, o.Label.Matches(labels.Set{OperationLabel: operationBackup}))
+		assert.False(t, o.Label.Matches(labels.Set{"app": "redis"}))
+	}
+	assert.Len(t, opts.ByObject, 1)
+}
@@ -0,0 +1,191 @@
+package custom
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+const (
+	// EnvBackupImage is the container image which runs backup and restore jobs.
+	EnvBackupImage = "OSB_BACKUP_IMAGE"
+	// EnvBackupSecret is the name of the secret holding the backup repository configuration.
+	EnvBackupSecret = "OSB_BACKUP_SECRET"
+	// EnvBackupRetention is the duration manual backups are kept for.
+	EnvBackupRetention = "OSB_BACKUP_RETENTION"
+	// EnvBinlogRetention is the duration MariaDB keeps its binary logs for.
+	EnvBinlogRetention = "OSB_MARIADB_BINLOG_RETENTION"
+	// EnvPrometheusURL is the base URL of the Prometheus compatible API usage history is queried from.
+	EnvPrometheusURL = "OSB_PROMETHEUS_URL"
+	// EnvProbeEndpoints enables probing the endpoints of instances before returning them.
+	EnvProbeEndpoints = "OSB_PROBE_ENDPOINTS"
+	// EnvAdminUsername and EnvAdminPassword are the credentials granting the admin role on the custom API.
+	EnvAdminUsername = "OSB_ADMIN_USERNAME"
+	EnvAdminPassword = "OSB_ADMIN_PASSWORD"
+	// EnvBrokerRole is the role the broker credentials grant on the custom API, either read-only or platform.
+	// It defaults to platform, which the marketplace needs to call the custom API.
+	EnvBrokerRole = "OSB_CUSTOM_API_BROKER_ROLE"
+	// EnvReadOnlyUsername and EnvReadOnlyPassword are the credentials granting the read-only role on the custom API.
+	EnvReadOnlyUsername = "OSB_READONLY_USERNAME"
+	EnvReadOnlyPassword = "OSB_READONLY_PASSWORD"
+	// EnvTokenIssuer and EnvTokenAudience are the issuer and audience bearer tokens of the custom API must name.
+	// Bearer tokens aren't accepted by the custom API if no issuer is configured.
+	EnvTokenIssuer   = "OSB_CUSTOM_API_TOKEN_ISSUER"
+	EnvTokenAudience = "OSB_CUSTOM_API_TOKEN_AUDIENCE"
+	// EnvMetricsListenAddr is the address metrics are served on, separate from the APIs.
+	EnvMetricsListenAddr = "OSB_METRICS_LISTEN_ADDR"
+
+	defaultMetricsListenAddr = ":9090"
+	defaultTokenAudience     = "swisscom-service-broker-custom-api"
+)
+
+// Config contains the configuration of the custom API.
+type Config struct {
+	// BackupImage is used for the jobs which take and restore backups.
+	// Backups are disabled if no image is configured.
+	BackupImage string
+	// BackupSecret is exposed to the backup jobs as environment variables and configures
+	// the repository backups are stored in.
+	BackupSecret string
+	// BackupRetention is the duration manual backups are kept after they have finished,
+	// after which the BackupPruner removes them from the backup repository.
+	// Backups are kept until they get deleted if no retention is configured.
+	BackupRetention time.Duration
+	// BinlogRetention must match the duration MariaDB keeps binary logs for.
+	// Point-in-time recovery is disabled if no retention is configured.
+	BinlogRetention time.Duration
+	// PrometheusURL is the base URL of the Prometheus compatible API usage history is queried from.
+	// The metrics of an instance must carry its ID in the PrometheusInstanceLabel.
+	// Usage history is disabled if no URL is configured.
+	PrometheusURL string
+	// ProbeEndpoints makes the endpoints of an instance only be returned once they accept connections.
+	// Otherwise the Ready condition of the instance is trusted.
+	ProbeEndpoints bool
+	// Namespace is the namespace of the broker, which revisions of service definitions are stored in.
+	// It is taken from the broker configuration, revisions aren't recorded if it isn't set.
+	Namespace string
+	// PlanUpdateSizeRule and PlanUpdateSLARule are the plan update rules of the broker configuration,
+	// service definitions are validated against.
+	PlanUpdateSizeRule string
+	PlanUpdateSLARule  string
+	// BrokerRole is the role the broker credentials grant on the custom API, RolePlatform if it is zero.
+	// The broker credentials never grant the admin role.
+	BrokerRole Role
+	// AdminCredential and ReadOnlyCredential grant access to the custom API in addition to the broker credentials.
+	// Unset if not configured, service definitions can't be managed without admin credentials.
+	AdminCredential    *Credential
+	ReadOnlyCredential *Credential
+	// TokenIssuer and TokenAudience must be named by bearer tokens of the custom API.
+	// Bearer tokens are only accepted if an issuer is configured, the audience has a default.
+	TokenIssuer   string
+	TokenAudience string
+	// MetricsListenAddr is the address metrics are served on without authentication.
+	// It must not be exposed publicly, :9090 by default.
+	MetricsListenAddr string
+}
+
+// ReadConfig reads env variables using the passed function.
+func ReadConfig(getEnv func(string) string) (*Config, error) {
+	cfg := Config{
+		BackupImage:   getEnv(EnvBackupImage),
+		BackupSecret:  getEnv(EnvBackupSecret),
+		PrometheusURL: getEnv(EnvPrometheusURL),
+
+		TokenIssuer:       getEnv(EnvTokenIssuer),
+		TokenAudience:     getEnv(EnvTokenAudience),
+		MetricsListenAddr: getEnv(EnvMetricsListenAddr),
+	}
+	if cfg.TokenAudience == "" {
+		cfg.TokenAudience = defaultTokenAudience
+	}
+	if cfg.MetricsListenAddr == "" {
+		cfg.MetricsListenAddr = defaultMetricsListenAddr
+	}
+
+	if r := getEnv(EnvBackupRetention); r != "" {
+		d, err := time.ParseDuration(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", EnvBackupRetention, err)
+		}
+		cfg.BackupRetention = d
+	}
+	if r := getEnv(EnvBinlogRetention); r != "" {
+		d, err := time.ParseDuration(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", EnvBinlogRetention, err)
+		}
+		cfg.BinlogRetention = d
+	}
+	var err error
+	cfg.AdminCredential, err = readCredential(getEnv, EnvAdminUsername, EnvAdminPassword, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ReadOnlyCredential, err = readCredential(getEnv, EnvReadOnlyUsername, EnvReadOnlyPassword, RoleReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if r := getEnv(EnvBrokerRole); r != "" {
+		switch r {
+		case RoleReadOnly.String():
+			cfg.BrokerRole = RoleReadOnly
+		case RolePlatform.String():
+			cfg.BrokerRole = RolePlatform
+		default:
+			return nil, fmt.Errorf("%s must be %q or %q", EnvBrokerRole, RoleReadOnly, RolePlatform)
+		}
+	}
+	if p := getEnv(EnvProbeEndpoints); p != "" {
+		b, err := strconv.ParseBool(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", EnvProbeEndpoints, err)
+		}
+		cfg.ProbeEndpoints = b
+	}
+
+	return &cfg, nil
+}
+
+// readCredential reads a credential from the given username and password variables, nil if neither is set.
+func readCredential(getEnv func(string) string, usernameEnv, passwordEnv string, role Role) (*Credential, error) {
+	username, password := getEnv(usernameEnv), getEnv(passwordEnv)
+	if username == "" && password == "" {
+		return nil, nil
+	}
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("%s and %s must be set together", usernameEnv, passwordEnv)
+	}
+	return &Credential{Username: username, Password: password, Role: role}, nil
+}
+
+// Credentials returns the credentials granting access to the custom API.
+// The broker credentials grant the platform role unless another broker role is configured.
+func (c Config) Credentials(username, password string) []Credential {
+	role := c.BrokerRole
+	if role == 0 {
+		role = RolePlatform
+	}
+	credentials := []Credential{{Username: username, Password: password, Role: role}}
+	for _, cred := range []*Credential{c.AdminCredential, c.ReadOnlyCredential} {
+		if cred != nil {
+			credentials = append(credentials, *cred)
+		}
+	}
+	return credentials
+}
+
+// Tokens returns the configuration of the bearer tokens accepted by the custom API, which are verified with the keys.
+// It returns nil if no issuer or no keys are configured.
+func (c Config) Tokens(keys *jwt.KeyRegister) *Tokens {
+	if c.TokenIssuer == "" || keys == nil {
+		return nil
+	}
+	return &Tokens{Keys: keys, Issuer: c.TokenIssuer, Audience: c.TokenAudience}
+}
+
+// BackupsEnabled returns true if everything required to run backup jobs is configured.
+func (c Config) BackupsEnabled() bool {
+	return c.BackupImage != "" && c.BackupSecret != ""
+}
@@ -1,6 +1,10 @@
 package custom
 
 import (
+	"encoding/json"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v8/domain"
 	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
 )
 
@@ -9,59 +13,372 @@ type APISpec interface {
 	// Endpoints lists service endpoints
 	// GET /custom/service_instances/{service_instance_id}/endpoint
 	Endpoints(rctx *reqcontext.ReqContext, instanceID string) ([]Endpoint, error)
-	// ServiceUsage returns service usage
+	// NodeEndpoints lists the load balanced endpoint and every node of a Galera cluster with its role
+	// GET /custom/service_instances/{service_instance_id}/endpoint?nodes=true
+	NodeEndpoints(rctx *reqcontext.ReqContext, instanceID string) ([]Endpoint, error)
+	// ServiceUsage returns the current service usage
 	// GET /custom/service_instances/{service_instance_id}/usage
 	ServiceUsage(rctx *reqcontext.ReqContext, instanceID string) (*ServiceUsage, error)
-	// CreateUpdateServiceDefinition is not implemented
-	// POST /custom/admin/service-definition
-	CreateUpdateServiceDefinition(rctx *reqcontext.ReqContext, sd *ServiceDefinitionRequest) error
-	// DeleteServiceDefinition is not implemented
+	// ServiceUsageHistory returns the service usage over a time range
+	// GET /custom/service_instances/{service_instance_id}/usage?from={from}&to={to}&step={step}
+	ServiceUsageHistory(rctx *reqcontext.ReqContext, instanceID string, r UsageRange) (*UsageHistory, error)
+	// CreateUpdateServiceDefinition creates or updates a service and its plans, a dry run only validates the definition
+	// POST /custom/admin/service-definition?dry_run={dry_run}
+	CreateUpdateServiceDefinition(rctx *reqcontext.ReqContext, sd *ServiceDefinitionRequest, dryRun bool) error
+	// ServiceDefinitionRevisions lists the revisions of a service definition, oldest first
+	// GET /custom/admin/service-definition/{id}/revisions
+	ServiceDefinitionRevisions(rctx *reqcontext.ReqContext, id string) ([]ServiceDefinitionRevision, error)
+	// RollbackServiceDefinition applies the definition of a previous revision, which is recorded as new revision
+	// POST /custom/admin/service-definition/{id}/revisions/{revision}/rollback
+	RollbackServiceDefinition(rctx *reqcontext.ReqContext, id string, revision int) (*ServiceDefinitionRevision, error)
+	// DeleteServiceDefinition removes a service or a plan which isn't used by any instance
 	// DELETE /custom/admin/service-definition/{id}
 	DeleteServiceDefinition(rctx *reqcontext.ReqContext, id string) error
-	// CreateBackup is not implemented
+	// CreateBackup starts a backup of a service instance
 	// POST /custom/service_instances/{service_instance_id}/backups
 	CreateBackup(rctx *reqcontext.ReqContext, instanceID string, b *BackupRequest) (*Backup, error)
-	// DeleteBackup is not implemented
+	// DeleteBackup deletes a backup of a service instance, the stored backup is cleaned up asynchronously
 	// DELETE /custom/service_instances/{service_instance_id}/backups/{backup_id}
-	DeleteBackup(rctx *reqcontext.ReqContext, instanceID, backupID string) (string, error)
-	// Backup is not implemented
+	DeleteBackup(rctx *reqcontext.ReqContext, instanceID, backupID string) error
+	// Backup returns a backup of a service instance
 	// GET /custom/service_instances/{service_instance_id}/backups/{backup_id}
 	Backup(rctx *reqcontext.ReqContext, instanceID, backupID string) (*Backup, error)
-	// ListBackups is not implemented
+	// ListBackups lists the backups of a service instance
 	// GET /custom/service_instances/{service_instance_id}/backups
-	ListBackups(rctx *reqcontext.ReqContext, instanceID string) ([]Backup, error)
-	// RestoreBackup is not implemented
+	ListBackups(rctx *reqcontext.ReqContext, instanceID string) (*BackupList, error)
+	// BackupSchedule returns the backup schedule of a service instance
+	// GET /custom/service_instances/{service_instance_id}/backup-schedule
+	BackupSchedule(rctx *reqcontext.ReqContext, instanceID string) (*BackupSchedule, error)
+	// SetBackupSchedule sets the backup schedule of a service instance, an empty schedule disables scheduled backups
+	// PUT /custom/service_instances/{service_instance_id}/backup-schedule
+	SetBackupSchedule(rctx *reqcontext.ReqContext, instanceID string, s *BackupSchedule) (*BackupSchedule, error)
+	// RestoreBackup starts restoring a backup into the service instance
 	// POST /custom/service_instances/{service_instance_id}/backups/{backup_id}/restores
 	RestoreBackup(rctx *reqcontext.ReqContext, instanceID, backupID string, r *RestoreRequest) (*Restore, error)
-	// RestoreStatus is not implemented
+	// RestoreStatus returns the status of a restore
 	// GET /custom/service_instances/{service_instance_id}/backups/{backup_id}/restores/{restore_id}
 	RestoreStatus(rctx *reqcontext.ReqContext, instanceID, backupID, restoreID string) (*Restore, error)
-	// APIDocs is not implemented
+	// APIDocs returns the OpenAPI document of the whole custom API
+	// GET /custom/api-docs
+	APIDocs(rctx *reqcontext.ReqContext) (*OpenAPI, error)
+	// InstanceAPIDocs returns the OpenAPI document of the custom API endpoints available for the service of the instance
 	// GET /custom/service_instances/{service_instance_id}/api-docs
-	APIDocs(rctx *reqcontext.ReqContext, instanceID string) (string, error)
+	InstanceAPIDocs(rctx *reqcontext.ReqContext, instanceID string) (*OpenAPI, error)
 }
 
 // Endpoint describes available service endpoints.
 type Endpoint struct {
-	Destination string `json:"destination"`
-	Ports       string `json:"ports"`
-	Protocol    string `json:"protocol"`
+	// Name of the endpoint such as "redis" or "sentinel".
+	Name        string       `json:"name"`
+	Destination string       `json:"destination"`
+	Ports       string       `json:"ports"`
+	Protocol    string       `json:"protocol"`
+	TLS         *EndpointTLS `json:"tls,omitempty"`
+	// Role of the endpoint within a cluster, only set when listing the nodes of a cluster.
+	Role string `json:"role,omitempty"`
+	// SentinelMaster is the master monitored by a Sentinel endpoint.
+	SentinelMaster *SentinelMaster `json:"sentinel_master,omitempty"`
+}
+
+// Names of the endpoints.
+const (
+	EndpointNameRedis    = "redis"
+	EndpointNameSentinel = "sentinel"
+	EndpointNameMariaDB  = "mariadb"
+)
+
+// SentinelMaster describes the master group monitored by Redis Sentinel.
+type SentinelMaster struct {
+	// Name of the master group clients ask Sentinel for.
+	Name string `json:"name"`
+	// Status tells whether the current master is known, see SentinelMasterResolved.
+	Status string `json:"status"`
+	// Destination and Port of the current master, empty unless it has been resolved.
+	Destination string `json:"destination,omitempty"`
+	Port        string `json:"port,omitempty"`
+}
+
+// States of the master of a SentinelMaster.
+const (
+	// SentinelMasterResolved is the state of masters reported by Sentinel.
+	SentinelMasterResolved = "resolved"
+	// SentinelMasterPending is the state of masters Sentinel hasn't been asked for yet, the request is on its way.
+	SentinelMasterPending = "pending"
+	// SentinelMasterUnavailable is the state of masters Sentinel couldn't be asked for or doesn't know about.
+	SentinelMasterUnavailable = "unavailable"
+)
+
+// Roles of the endpoints of a Galera cluster.
+const (
+	// EndpointRoleLoadBalancer is the load balanced address of the cluster.
+	EndpointRoleLoadBalancer = "load-balancer"
+	// EndpointRoleWriter is the node the load balancer currently sends all queries to.
+	EndpointRoleWriter = "writer"
+	// EndpointRoleReader is a synced node which can serve reads.
+	EndpointRoleReader = "reader"
+	// EndpointRoleDonor is a node providing the state transfer to a joining node, it may lag behind.
+	EndpointRoleDonor = "donor"
+	// EndpointRoleSyncing is a node joining the cluster which doesn't have all data yet.
+	EndpointRoleSyncing = "syncing"
+	// EndpointRoleUnavailable is a node the broker can't query.
+	EndpointRoleUnavailable = "unavailable"
+)
+
+// EndpointTLS describes how to connect to an endpoint using TLS.
+type EndpointTLS struct {
+	// Required is set if the endpoint doesn't accept connections without TLS.
+	Required bool `json:"required"`
+	// Port accepting TLS connections.
+	Port string `json:"port"`
+	// CACertificate is the PEM encoded CA certificate to verify the server certificate with.
+	CACertificate string `json:"ca_certificate,omitempty"`
+	// CAFingerprint is the SHA-256 fingerprint of the CA certificate.
+	CAFingerprint string `json:"ca_fingerprint,omitempty"`
+}
+
+// ServiceUsage describes the current usage of a service instance.
+// Only the usage of the service of the instance is set.
+type ServiceUsage struct {
+	Redis   *RedisUsage   `json:"redis,omitempty"`
+	MariaDB *MariaDBUsage `json:"mariadb,omitempty"`
+}
+
+// RedisUsage describes the usage of a Redis instance.
+type RedisUsage struct {
+	// UsedMemory in bytes.
+	UsedMemory int64 `json:"used_memory"`
+	// MaxMemory is the memory limit of the instance in bytes, 0 if unlimited.
+	MaxMemory        int64            `json:"max_memory"`
+	ConnectedClients int64            `json:"connected_clients"`
+	Keys             int64            `json:"keys"`
+	OpsPerSec        int64            `json:"ops_per_sec"`
+	Persistence      RedisPersistence `json:"persistence"`
 }
 
-// ServiceUsage is a placeholder
-type ServiceUsage struct{}
+// UsageRange is the time range and resolution of a usage history.
+type UsageRange struct {
+	From time.Time
+	To   time.Time
+	Step time.Duration
+}
+
+// UsageHistory describes the usage of a service instance over a time range.
+type UsageHistory struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Step is the resolution of the samples formatted as duration, e.g. "5m0s".
+	Step   string        `json:"step"`
+	Series []UsageSeries `json:"series"`
+}
+
+// UsageSeries holds the samples of a usage metric.
+// Metrics reported per database carry the database name in the schema label.
+type UsageSeries struct {
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Samples []UsageSample     `json:"samples"`
+}
 
-// Backup is a placeholder
-type Backup struct{}
+// UsageSample is the value of a usage metric at a point in time.
+type UsageSample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
 
-// Restore is a placeholder
-type Restore struct{}
+// MariaDBUsage describes the usage of a MariaDB Galera cluster or of a single database.
+type MariaDBUsage struct {
+	Databases         []DatabaseUsage `json:"databases"`
+	ActiveConnections int64           `json:"active_connections"`
+	MaxConnections    int64           `json:"max_connections"`
+	Cluster           *GaleraStatus   `json:"cluster,omitempty"`
+}
 
-// ServiceDefinitionRequest is a placeholder
-type ServiceDefinitionRequest struct{}
+// DatabaseUsage describes the storage used by a database.
+type DatabaseUsage struct {
+	Name string `json:"name"`
+	// Size of data and indexes in bytes.
+	Size   int64 `json:"size"`
+	Tables int64 `json:"tables"`
+}
+
+// GaleraStatus describes the state of a Galera cluster.
+type GaleraStatus struct {
+	Size       int    `json:"size"`
+	Status     string `json:"status"`
+	LocalState string `json:"local_state"`
+}
+
+// RedisPersistence describes the persistence status of a Redis instance.
+type RedisPersistence struct {
+	RDBLastSaveTime    time.Time `json:"rdb_last_save_time"`
+	RDBLastSaveStatus  string    `json:"rdb_last_save_status"`
+	AOFEnabled         bool      `json:"aof_enabled"`
+	AOFLastWriteStatus string    `json:"aof_last_write_status,omitempty"`
+}
+
+// OperationStatus is the status of a backup or restore.
+type OperationStatus string
+
+const (
+	// OperationPending means the operation has not started yet.
+	OperationPending OperationStatus = "pending"
+	// OperationRunning means the operation is in progress.
+	OperationRunning OperationStatus = "running"
+	// OperationSucceeded means the operation has completed successfully.
+	OperationSucceeded OperationStatus = "succeeded"
+	// OperationFailed means the operation has failed.
+	OperationFailed OperationStatus = "failed"
+)
 
-// BackupRequest is a placeholder
+// BackupType tells how a backup has been started.
+type BackupType string
+
+const (
+	// BackupManual is a backup started through the API.
+	BackupManual BackupType = "manual"
+	// BackupScheduled is a backup started by the backup schedule of an instance.
+	BackupScheduled BackupType = "scheduled"
+)
+
+// Backup describes a backup of a service instance.
+type Backup struct {
+	ID         string          `json:"id"`
+	Type       BackupType      `json:"type"`
+	Status     OperationStatus `json:"status"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time      `json:"expires_at,omitempty"`
+	Size       int64           `json:"size"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Restore describes the restore of a backup.
+type Restore struct {
+	ID         string          `json:"id"`
+	BackupID   string          `json:"backup_id"`
+	InstanceID string          `json:"instance_id"`
+	Status     OperationStatus `json:"status"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// ServiceDefinitionRequest describes a service and its plans.
+// The service is backed by an existing CompositeResourceDefinition, each plan by a Composition
+// which is copied from the referenced composition.
+type ServiceDefinitionRequest struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// CompositeResourceDefinition is the name of the definition backing the service.
+	CompositeResourceDefinition string           `json:"composite_resource_definition"`
+	Bindable                    bool             `json:"bindable"`
+	PlanUpdatable               bool             `json:"plan_updateable"`
+	Tags                        []string         `json:"tags,omitempty"`
+	Metadata                    json.RawMessage  `json:"metadata,omitempty"`
+	Plans                       []PlanDefinition `json:"plans"`
+}
+
+// PlanDefinition describes a plan of a service.
+type PlanDefinition struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Metadata    json.RawMessage `json:"metadata,omitempty"`
+	// Bindable and Updatable default to the setting of the service.
+	Bindable  *bool  `json:"bindable,omitempty"`
+	Updatable *bool  `json:"plan_updateable,omitempty"`
+	SLA       string `json:"sla,omitempty"`
+	// Deprecated plans are hidden from the catalog and can't be provisioned anymore,
+	// existing instances keep working.
+	Deprecated bool `json:"deprecated,omitempty"`
+	// CompositionRef is the name of the composition the composition of the plan is copied from.
+	CompositionRef string `json:"composition_ref"`
+	// Schemas describe the parameters accepted by the plan as JSON schema.
+	Schemas *domain.ServiceSchemas `json:"schemas,omitempty"`
+}
+
+// ValidationErrorResponse lists all violations of an invalid request.
+type ValidationErrorResponse struct {
+	Error       string   `json:"error"`
+	Description string   `json:"description"`
+	Violations  []string `json:"violations"`
+}
+
+// ServiceDefinitionRevision is a recorded change of a service definition.
+type ServiceDefinitionRevision struct {
+	ServiceID string    `json:"service_id"`
+	Revision  int       `json:"revision"`
+	CreatedAt time.Time `json:"created_at"`
+	// Author is the originating identity of the request which changed the definition, if the platform passed one.
+	Author *OriginatingIdentity `json:"author,omitempty"`
+	// RollbackOf is set to the revision rolled back to if the change has been a rollback.
+	RollbackOf *int `json:"rollback_of,omitempty"`
+	// Diff is the JSON patch (RFC 6902) turning the definition of the previous revision into this one.
+	Diff       json.RawMessage           `json:"diff"`
+	Definition *ServiceDefinitionRequest `json:"definition"`
+}
+
+// OriginatingIdentity is the identity of the platform user a request has been made on behalf of,
+// as passed by the platform in the X-Broker-API-Originating-Identity header.
+type OriginatingIdentity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value"`
+}
+
+// BackupRequest describes a backup to be taken.
 type BackupRequest struct{}
 
-// RestoreRequest is a placeholder
-type RestoreRequest struct{}
+// BackupList lists the backups of a service instance.
+type BackupList struct {
+	Backups []Backup `json:"backups"`
+	// RecoveryWindow is only set for instances supporting point-in-time recovery.
+	RecoveryWindow *RecoveryWindow `json:"recovery_window,omitempty"`
+}
+
+// RecoveryWindow is the time range a service instance can be restored to.
+type RecoveryWindow struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// BackupSchedule describes when backups of a service instance are taken and how long they are kept.
+type BackupSchedule struct {
+	// Schedule is a cron expression, scheduled backups are disabled if it is empty.
+	Schedule  string          `json:"schedule"`
+	Retention RetentionPolicy `json:"retention"`
+	// LastScheduleTime is the time the last scheduled backup has been started.
+	LastScheduleTime *time.Time `json:"last_schedule_time,omitempty"`
+}
+
+// RetentionPolicy describes which scheduled backups are kept.
+type RetentionPolicy struct {
+	KeepDaily   int `json:"keep_daily"`
+	KeepWeekly  int `json:"keep_weekly"`
+	KeepMonthly int `json:"keep_monthly"`
+}
+
+// RestoreMode tells where a backup gets restored to.
+type RestoreMode string
+
+const (
+	// RestoreInPlace restores a backup into the instance it has been taken of.
+	RestoreInPlace RestoreMode = "in_place"
+	// RestoreNewInstance restores a backup into a new instance provisioned by the platform.
+	RestoreNewInstance RestoreMode = "new_instance"
+)
+
+// RestoreRequest describes how a backup is restored.
+type RestoreRequest struct {
+	// Mode defaults to RestoreInPlace.
+	Mode RestoreMode `json:"mode,omitempty"`
+	// TargetInstanceID is the instance provisioned by the platform to restore the backup into, required with
+	// RestoreNewInstance. Its plan must be the plan of the source or one the source could be updated to by the
+	// plan update size rules.
+	TargetInstanceID string `json:"target_instance_id,omitempty"`
+	// TargetTime is the point in time the instance is recovered to by replaying the binary logs
+	// written after the backup has been taken. Only supported by MariaDB.
+	TargetTime *time.Time `json:"target_time,omitempty"`
+}
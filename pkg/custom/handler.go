@@ -1,14 +1,30 @@
 package custom
 
 import (
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
 	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
 	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
 )
@@ -20,27 +36,152 @@ var errNotImplemented = apiresponses.NewFailureResponseBuilder(
 	WithErrorKey("NotImplemented").
 	Build()
 
+var errBackupsDisabled = apiresponses.NewFailureResponseBuilder(
+	errors.New("backups are not configured"),
+	http.StatusNotImplemented,
+	"backups-disabled").
+	WithErrorKey("NotImplemented").
+	Build()
+
+var errBackupInProgress = apiresponses.NewFailureResponseBuilder(
+	errors.New("a backup of this instance has just been started"),
+	http.StatusConflict,
+	"backup-in-progress").
+	WithErrorKey("ConcurrencyError").
+	Build()
+
+var errBackupDoesNotExist = apiresponses.NewFailureResponseBuilder(
+	errors.New("backup does not exist"),
+	http.StatusNotFound,
+	"backup-does-not-exist").
+	WithErrorKey("BackupDoesNotExist").
+	Build()
+
+var errBackupInUse = apiresponses.NewFailureResponseBuilder(
+	errors.New("backup is used by a running restore"),
+	http.StatusConflict,
+	"backup-in-use").
+	WithErrorKey("BackupInUse").
+	Build()
+
+var errBackupNotRestorable = apiresponses.NewFailureResponseBuilder(
+	errors.New("only successfully completed backups can be restored"),
+	http.StatusUnprocessableEntity,
+	"backup-not-restorable").
+	WithErrorKey("BackupNotRestorable").
+	Build()
+
+var errBackupRunning = apiresponses.NewFailureResponseBuilder(
+	errors.New("backup is still running"),
+	http.StatusConflict,
+	"backup-running").
+	WithErrorKey("ConcurrencyError").
+	Build()
+
+var errRestoreInProgress = apiresponses.NewFailureResponseBuilder(
+	errors.New("a restore into this instance is already in progress"),
+	http.StatusConflict,
+	"restore-in-progress").
+	WithErrorKey("ConcurrencyError").
+	Build()
+
+var errRestoreDoesNotExist = apiresponses.NewFailureResponseBuilder(
+	errors.New("restore does not exist"),
+	http.StatusNotFound,
+	"restore-does-not-exist").
+	WithErrorKey("RestoreDoesNotExist").
+	Build()
+
+var errPointInTimeRecoveryNotSupported = apiresponses.NewFailureResponseBuilder(
+	errors.New("point-in-time recovery is only supported for MariaDB instances"),
+	http.StatusUnprocessableEntity,
+	"point-in-time-recovery-not-supported").
+	WithErrorKey("PointInTimeRecoveryNotSupported").
+	Build()
+
+var errUsageHistoryDisabled = apiresponses.NewFailureResponseBuilder(
+	errors.New("usage history is not configured"),
+	http.StatusNotImplemented,
+	"usage-history-disabled").
+	WithErrorKey("NotImplemented").
+	Build()
+
+var errServiceDefinitionDoesNotExist = apiresponses.NewFailureResponseBuilder(
+	errors.New("service or plan does not exist"),
+	http.StatusNotFound,
+	"service-definition-does-not-exist").
+	WithErrorKey("ServiceDefinitionDoesNotExist").
+	Build()
+
+var errRevisionsDisabled = apiresponses.NewFailureResponseBuilder(
+	errors.New("service definition revisions are not configured"),
+	http.StatusNotImplemented,
+	"revisions-disabled").
+	WithErrorKey("NotImplemented").
+	Build()
+
+var errRevisionDoesNotExist = apiresponses.NewFailureResponseBuilder(
+	errors.New("revision does not exist"),
+	http.StatusNotFound,
+	"revision-does-not-exist").
+	WithErrorKey("RevisionDoesNotExist").
+	Build()
+
 // APIHandler handles the actual implementations and implements APISpec
 type APIHandler struct {
-	cp  *crossplane.Crossplane
-	log lager.Logger
+	instances *instanceCache
+	sentinels *sentinelMasterCache
+	client    client.Client
+	config    *Config
+	log       lager.Logger
 }
 
 // NewAPIHandler sets up a new instance.
-func NewAPIHandler(c *crossplane.Crossplane, log lager.Logger) *APIHandler {
-	return &APIHandler{c, log}
+// Instances and their connection details are read from the cache if one is given, it must be started separately.
+func NewAPIHandler(c *crossplane.Crossplane, cl client.Client, ca cache.Cache, config *Config, log lager.Logger) *APIHandler {
+	var (
+		reader    client.Reader
+		informers informerSource
+	)
+	if ca != nil {
+		reader, informers = ca, ca
+	}
+	return &APIHandler{newInstanceCache(c, reader, informers), newSentinelMasterCache(log), cl, config, log}
+}
+
+// findInstance returns the requested instance and whether it exists.
+// The request must be authorized to access the instance, see authorizeInstance.
+func (h APIHandler) findInstance(rctx *reqcontext.ReqContext, instanceID string) (*crossplane.Instance, bool, error) {
+	instance, exists, err := h.instances.findInstance(rctx, instanceID)
+	if err != nil || !exists {
+		return instance, exists, err
+	}
+	if err := authorizeInstance(rctx.Context, instance); err != nil {
+		return nil, false, err
+	}
+	return instance, true, nil
 }
 
 // Endpoints retrieves the endpoints using the service binder.
 func (h APIHandler) Endpoints(rctx *reqcontext.ReqContext, instanceID string) ([]Endpoint, error) {
-	instance, _, exists, err := h.cp.FindInstanceWithoutPlan(rctx, instanceID)
+	instance, exists, err := h.findInstance(rctx, instanceID)
 	if err != nil {
 		return nil, err
 	}
 	if !exists {
 		return nil, apiresponses.ErrInstanceDoesNotExist
 	}
+	return h.endpoints(rctx, instance)
+}
 
+// endpoints retrieves the endpoints of an instance from its connection details.
+// The instance must be ready and, if probing is enabled, its endpoints must accept connections.
+func (h APIHandler) endpoints(rctx *reqcontext.ReqContext, instance *crossplane.Instance) ([]Endpoint, error) {
+	if err := checkReady(instance); err != nil {
+		return nil, err
+	}
+	instanceID := instance.ID()
+	var err error
 	// Get connection details of the actual Galera cluster
 	if instance.Labels.ServiceName == crossplane.MariaDBDatabaseService {
 		instance, err = h.getGaleraClusterFromDB(rctx, instance)
@@ -49,42 +190,185 @@ func (h APIHandler) Endpoints(rctx *reqcontext.ReqContext, instanceID string) ([
 		}
 	}
 
-	connectionDetails, err := h.cp.GetConnectionDetails(rctx.Context, instance.Composite)
+	connectionDetails, err := h.instances.connectionDetails(rctx.Context, instance.Composite)
 	if err != nil {
 		return nil, err
 	}
+	endpoints, err := connectionEndpoints(instance, connectionDetails)
+	if err != nil {
+		return nil, err
+	}
+	if h.config.ProbeEndpoints {
+		if err := probeEndpoints(rctx.Context, instanceID, endpoints); err != nil {
+			return nil, err
+		}
+	}
+
+	// The endpoints are useful without the current master as well, clients ask Sentinel themselves.
+	for _, e := range endpoints {
+		if e.SentinelMaster != nil {
+			addr, tlsConfig, err := dialTarget(e)
+			if err != nil {
+				return nil, err
+			}
+			h.sentinels.master(addr, string(connectionDetails.Data[xrv1.ResourceCredentialsSecretPasswordKey]), tlsConfig, e.SentinelMaster)
+		}
+	}
+	return endpoints, nil
+}
 
+// connectionEndpoints returns the endpoints of an instance as found in its connection details.
+func connectionEndpoints(instance *crossplane.Instance, connectionDetails *corev1.Secret) ([]Endpoint, error) {
 	dest := string(connectionDetails.Data[xrv1.ResourceCredentialsSecretEndpointKey])
 	port := string(connectionDetails.Data[xrv1.ResourceCredentialsSecretPortKey])
 
 	if len(dest) == 0 || len(port) == 0 {
-		return nil, fmt.Errorf("instance %q is not yet ready", instanceID)
+		return nil, errInstanceNotReady(instance.ID())
 	}
 
+	tls, err := endpointTLS(connectionDetails.Data, TLSPortKey, port)
+	if err != nil {
+		return nil, err
+	}
+	name := string(instance.Labels.ServiceName)
+	switch instance.Labels.ServiceName {
+	case crossplane.RedisService:
+		name = EndpointNameRedis
+	case crossplane.MariaDBService, crossplane.MariaDBDatabaseService:
+		name = EndpointNameMariaDB
+	}
 	endpoints := []Endpoint{
 		{
+			Name:        name,
 			Destination: dest,
 			Ports:       port,
 			Protocol:    "tcp",
+			TLS:         tls,
 		},
 	}
 	if instance.Labels.ServiceName == crossplane.RedisService {
+		sentinelPort := string(connectionDetails.Data["sentinelPort"])
+		sentinelTLS, err := endpointTLS(connectionDetails.Data, SentinelTLSPortKey, sentinelPort)
+		if err != nil {
+			return nil, err
+		}
+		master := string(connectionDetails.Data[SentinelMasterKey])
+		if master == "" {
+			master = defaultSentinelMaster
+		}
 		endpoints = append(endpoints, Endpoint{
-			Destination: dest,
-			Ports:       string(connectionDetails.Data["sentinelPort"]),
-			Protocol:    "tcp",
+			Name:           EndpointNameSentinel,
+			Destination:    dest,
+			Ports:          sentinelPort,
+			Protocol:       "tcp",
+			TLS:            sentinelTLS,
+			SentinelMaster: &SentinelMaster{Name: master},
 		})
 	}
 
 	return endpoints, nil
 }
 
+// NodeEndpoints lists the load balanced endpoint of a Galera cluster followed by its nodes.
+// The nodes are taken from the cluster status and queried one by one for their state.
+func (h APIHandler) NodeEndpoints(rctx *reqcontext.ReqContext, instanceID string) ([]Endpoint, error) {
+	instance, exists, err := h.findInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apiresponses.ErrInstanceDoesNotExist
+	}
+
+	if err := checkReady(instance); err != nil {
+		return nil, err
+	}
+
+	cluster := instance
+	switch instance.Labels.ServiceName {
+	case crossplane.MariaDBService:
+	case crossplane.MariaDBDatabaseService:
+		cluster, err = h.getGaleraClusterFromDB(rctx, instance)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errNodeEndpointsNotSupported(instance.Labels.ServiceName)
+	}
+
+	connectionDetails, err := h.instances.connectionDetails(rctx.Context, cluster.Composite)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := connectionEndpoints(cluster, connectionDetails)
+	if err != nil {
+		return nil, err
+	}
+	lb := endpoints[0]
+	lb.Role = EndpointRoleLoadBalancer
+
+	db, err := openMariaDB(connectionDetails, lb)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	nodes, err := queryGaleraNodes(rctx.Context, db, func(addr string) (*sql.DB, error) {
+		e, err := galeraNodeEndpoint(lb, addr)
+		if err != nil {
+			return nil, err
+		}
+		return openMariaDB(connectionDetails, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints = []Endpoint{lb}
+	for _, n := range nodes {
+		if n.err != nil {
+			rctx.Logger.Info("galera-node-unavailable", lager.Data{"node": n.addr, "error": n.err.Error()})
+		}
+		e, err := galeraNodeEndpoint(lb, n.addr)
+		if err != nil {
+			return nil, err
+		}
+		e.Role = n.role
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// galeraNodeEndpoint returns the endpoint of the Galera node at the address, given the load balanced endpoint of its cluster.
+func galeraNodeEndpoint(lb Endpoint, addr string) (Endpoint, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid address of Galera node %q: %w", addr, err)
+	}
+	e := Endpoint{Name: lb.Name, Destination: host, Ports: port, Protocol: lb.Protocol}
+	if lb.TLS != nil && lb.TLS.Port == lb.Ports {
+		// Nodes only accept TLS on their regular port
+		tls := *lb.TLS
+		tls.Port = port
+		e.TLS = &tls
+	}
+	return e, nil
+}
+
+func errNodeEndpointsNotSupported(service crossplane.ServiceName) error {
+	return apiresponses.NewFailureResponseBuilder(
+		fmt.Errorf("listing nodes is not supported for service %q", service),
+		http.StatusUnprocessableEntity,
+		"node-endpoints-not-supported").
+		WithErrorKey("NodeEndpointsNotSupported").
+		Build()
+}
+
 func (h APIHandler) getGaleraClusterFromDB(rctx *reqcontext.ReqContext, db *crossplane.Instance) (*crossplane.Instance, error) {
 	pRef, err := db.ParentReference()
 	if err != nil {
 		return nil, err
 	}
-	inst, _, ok, err := h.cp.FindInstanceWithoutPlan(rctx, pRef)
+	inst, ok, err := h.instances.findInstance(rctx, pRef)
 	if err != nil {
 		return nil, err
 	}
@@ -94,52 +378,1208 @@ func (h APIHandler) getGaleraClusterFromDB(rctx *reqcontext.ReqContext, db *cros
 	return inst, nil
 }
 
-// ServiceUsage is not implemented
+// ServiceUsage gathers the current usage from the instance itself.
 func (h APIHandler) ServiceUsage(rctx *reqcontext.ReqContext, instanceID string) (*ServiceUsage, error) {
-	return nil, errNotImplemented
+	instance, exists, err := h.findInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apiresponses.ErrInstanceDoesNotExist
+	}
+
+	switch instance.Labels.ServiceName {
+	case crossplane.RedisService:
+		u, err := h.redisUsage(rctx, instance)
+		if err != nil {
+			return nil, err
+		}
+		return &ServiceUsage{Redis: u}, nil
+	case crossplane.MariaDBService, crossplane.MariaDBDatabaseService:
+		u, err := h.mariaDBUsage(rctx, instance)
+		if err != nil {
+			return nil, err
+		}
+		return &ServiceUsage{MariaDB: u}, nil
+	default:
+		return nil, errNotImplemented
+	}
+}
+
+// ServiceUsageHistory queries the usage over the given range from Prometheus.
+func (h APIHandler) ServiceUsageHistory(rctx *reqcontext.ReqContext, instanceID string, r UsageRange) (*UsageHistory, error) {
+	if h.config.PrometheusURL == "" {
+		return nil, errUsageHistoryDisabled
+	}
+	if err := validateUsageRange(r); err != nil {
+		return nil, err
+	}
+
+	instance, exists, err := h.findInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apiresponses.ErrInstanceDoesNotExist
+	}
+
+	cluster := instance
+	if instance.Labels.ServiceName == crossplane.MariaDBDatabaseService {
+		cluster, err = h.getGaleraClusterFromDB(rctx, instance)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	queries, err := usageQueries(instance, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return queryUsageHistory(rctx.Context, newPrometheusClient(h.config.PrometheusURL), queries, r)
 }
 
-// CreateUpdateServiceDefinition is not implemented
-func (h APIHandler) CreateUpdateServiceDefinition(rctx *reqcontext.ReqContext, sd *ServiceDefinitionRequest) error {
-	return errNotImplemented
+// validateUsageRange ensures the range results in at least one and at most maxUsageSamples samples.
+func validateUsageRange(r UsageRange) error {
+	var err error
+	switch {
+	case !r.From.Before(r.To):
+		err = errors.New("from must be before to")
+	case r.Step <= 0:
+		err = errors.New("step must be positive")
+	case r.To.Sub(r.From)/r.Step >= maxUsageSamples:
+		err = fmt.Errorf("range results in more than %d samples, increase the step", maxUsageSamples)
+	}
+	if err != nil {
+		return apiresponses.NewFailureResponseBuilder(err, http.StatusUnprocessableEntity, "invalid-usage-range").
+			WithErrorKey("InvalidUsageRange").
+			Build()
+	}
+	return nil
 }
 
-// DeleteServiceDefinition is not implemented
-func (h APIHandler) DeleteServiceDefinition(rctx *reqcontext.ReqContext, id string) error {
-	return errNotImplemented
+// mariaDBUsage retrieves the usage of a Galera cluster, or of a single database by querying its cluster.
+func (h APIHandler) mariaDBUsage(rctx *reqcontext.ReqContext, instance *crossplane.Instance) (*MariaDBUsage, error) {
+	cluster := instance
+	database := ""
+	if instance.Labels.ServiceName == crossplane.MariaDBDatabaseService {
+		var err error
+		cluster, err = h.getGaleraClusterFromDB(rctx, instance)
+		if err != nil {
+			return nil, err
+		}
+		database = instance.ID()
+	}
+
+	connectionDetails, err := h.instances.connectionDetails(rctx.Context, cluster.Composite)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := connectionEndpoints(instance, connectionDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openMariaDB(connectionDetails, endpoints[0])
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return queryMariaDBUsage(rctx.Context, db, database)
 }
 
-// CreateBackup is not implemented
-func (h APIHandler) CreateBackup(rctx *reqcontext.ReqContext, instanceID string, b *BackupRequest) (*Backup, error) {
-	return nil, errNotImplemented
+// redisUsage retrieves the usage of a Redis instance with the INFO command.
+func (h APIHandler) redisUsage(rctx *reqcontext.ReqContext, instance *crossplane.Instance) (*RedisUsage, error) {
+	connectionDetails, err := h.instances.connectionDetails(rctx.Context, instance.Composite)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := connectionEndpoints(instance, connectionDetails)
+	if err != nil {
+		return nil, err
+	}
+	addr, tlsConfig, err := dialTarget(endpoints[0])
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dialRedis(rctx.Context, addr, string(connectionDetails.Data[xrv1.ResourceCredentialsSecretPasswordKey]), tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	reply, err := c.Do("INFO")
+	if err != nil {
+		return nil, err
+	}
+	info, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to INFO: %v", reply)
+	}
+	return redisUsageFromInfo(parseRedisInfo(info))
 }
 
-// DeleteBackup is not implemented
-func (h APIHandler) DeleteBackup(rctx *reqcontext.ReqContext, instanceID, backupID string) (string, error) {
-	return "", errNotImplemented
+// CreateUpdateServiceDefinition labels the CompositeResourceDefinition of the service and creates or updates
+// a Composition per plan, copied from the composition referenced by the plan.
+// Plans which are not part of the definition anymore are deprecated, which hides them from the catalog
+// while instances using them keep working.
+// Every change is recorded as a revision of the definition.
+// A dry run validates the definition and checks the referenced objects without changing anything.
+func (h APIHandler) CreateUpdateServiceDefinition(rctx *reqcontext.ReqContext, sd *ServiceDefinitionRequest, dryRun bool) error {
+	if err := validateServiceDefinition(sd, h.config); err != nil {
+		return err
+	}
+	if dryRun {
+		if _, err := h.serviceDefinitionChanges(rctx, sd, false); err != nil {
+			return err
+		}
+		rctx.Logger.Info("service-definition-validated", lager.Data{"service-id": sd.ID})
+		return nil
+	}
+	_, err := h.applyServiceDefinitionRequest(rctx, sd, nil)
+	return err
 }
 
-// Backup is not implemented
-func (h APIHandler) Backup(rctx *reqcontext.ReqContext, instanceID, backupID string) (*Backup, error) {
-	return nil, errNotImplemented
+// applyServiceDefinitionRequest records the definition as a new revision and applies it.
+// The revision is recorded first so that no definition is applied without being recorded.
+// It is removed again if applying the definition fails.
+// A rollback restores the plans of the revision exactly, see serviceDefinitionChanges.
+func (h APIHandler) applyServiceDefinitionRequest(rctx *reqcontext.ReqContext, sd *ServiceDefinitionRequest, rollbackOf *int) (*ServiceDefinitionRevision, error) {
+	changes, err := h.serviceDefinitionChanges(rctx, sd, rollbackOf != nil)
+	if err != nil {
+		return nil, err
+	}
+	r, recorded, err := h.recordRevision(rctx, sd, rollbackOf)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.applyChanges(rctx, changes); err != nil {
+		if recorded {
+			h.removeRevision(rctx, sd.ID, r.Revision)
+		}
+		return nil, err
+	}
+	rctx.Logger.Info("service-definition-applied", lager.Data{"service-id": sd.ID, "plans": len(sd.Plans), "changes": len(changes)})
+	return r, nil
 }
 
-// ListBackups is not implemented
-func (h APIHandler) ListBackups(rctx *reqcontext.ReqContext, instanceID string) ([]Backup, error) {
-	return nil, errNotImplemented
+// objectChange is a change of an object the catalog is built from.
+// The previous state is nil if the object doesn't exist yet, the desired state is nil if the object gets deleted.
+type objectChange struct {
+	previous *unstructured.Unstructured
+	desired  *unstructured.Unstructured
 }
 
-// RestoreBackup is not implemented
-func (h APIHandler) RestoreBackup(rctx *reqcontext.ReqContext, instanceID, backupID string, r *RestoreRequest) (*Restore, error) {
-	return nil, errNotImplemented
+// serviceDefinitionChanges checks the objects referenced by the definition and returns the changes applying it.
+// Nothing is changed yet, so that a definition which can't be applied doesn't leave the catalog partially changed.
+// Plans which are not part of the definition are deprecated. If the plans must match the definition exactly,
+// as they must for a rollback, they are deleted instead, unless instances still use them.
+func (h APIHandler) serviceDefinitionChanges(rctx *reqcontext.ReqContext, sd *ServiceDefinitionRequest, exact bool) ([]objectChange, error) {
+	xrd := newCompositeResourceDefinition(sd.CompositeResourceDefinition)
+	if err := h.client.Get(rctx.Context, client.ObjectKeyFromObject(xrd), xrd); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, errServiceDefinitionUnprocessable(fmt.Errorf("composite resource definition %q does not exist", sd.CompositeResourceDefinition))
+		}
+		return nil, err
+	}
+	if id, ok := xrd.GetLabels()[crossplane.ServiceIDLabel]; ok && id != sd.ID {
+		return nil, errServiceDefinitionConflict(fmt.Errorf("composite resource definition %q already defines service %q", xrd.GetName(), id))
+	}
+	desiredXRD := xrd.DeepCopy()
+	if err := applyServiceDefinition(desiredXRD, sd); err != nil {
+		return nil, err
+	}
+	changes := []objectChange{{previous: xrd, desired: desiredXRD}}
+
+	planIDs := make(map[string]bool, len(sd.Plans))
+	for i := range sd.Plans {
+		p := &sd.Plans[i]
+		planIDs[p.ID] = true
+		template := newComposition(p.CompositionRef)
+		if err := h.client.Get(rctx.Context, client.ObjectKeyFromObject(template), template); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, errServiceDefinitionUnprocessable(fmt.Errorf("composition %q of plan %q does not exist", p.CompositionRef, p.ID))
+			}
+			return nil, err
+		}
+		if kind := compositionCompositeKind(template); kind != compositeKind(xrd) {
+			return nil, errServiceDefinitionUnprocessable(fmt.Errorf("composition %q of plan %q composes %q instead of %q", p.CompositionRef, p.ID, kind, compositeKind(xrd)))
+		}
+
+		c := objectChange{previous: newComposition(p.ID)}
+		err := h.client.Get(rctx.Context, client.ObjectKeyFromObject(c.previous), c.previous)
+		if apierrors.IsNotFound(err) {
+			c.previous, c.desired = nil, newComposition(p.ID)
+		} else if err != nil {
+			return nil, err
+		} else {
+			if id, ok := c.previous.GetLabels()[crossplane.ServiceIDLabel]; ok && id != sd.ID {
+				return nil, errServiceDefinitionConflict(fmt.Errorf("plan %q already belongs to service %q", p.ID, id))
+			}
+			c.desired = c.previous.DeepCopy()
+		}
+		if err := applyPlanDefinition(c.desired, template, sd, p); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+
+	plans := newList(compositionGVK)
+	if err := h.client.List(rctx.Context, plans, client.MatchingLabels{crossplane.ServiceIDLabel: sd.ID}); err != nil {
+		return nil, err
+	}
+	var composites []unstructured.Unstructured
+	listed := false
+	for i := range plans.Items {
+		comp := &plans.Items[i]
+		if planIDs[comp.GetName()] {
+			continue
+		}
+		if exact && !listed {
+			var err error
+			if composites, err = h.listComposites(rctx, xrd); err != nil {
+				return nil, err
+			}
+			listed = true
+		}
+		inUse := len(usedByInstances(composites, func(c *unstructured.Unstructured) bool {
+			return compositionName(c) == comp.GetName()
+		})) > 0
+		c := objectChange{previous: comp}
+		if !exact || inUse {
+			c.desired = comp.DeepCopy()
+			deprecatePlan(c.desired)
+		}
+		changes = append(changes, c)
+	}
+
+	changed := changes[:0]
+	for _, c := range changes {
+		if c.previous == nil || c.desired == nil || !equality.Semantic.DeepEqual(c.previous.Object, c.desired.Object) {
+			changed = append(changed, c)
+		}
+	}
+	return changed, nil
 }
 
-// RestoreStatus is not implemented
-func (h APIHandler) RestoreStatus(rctx *reqcontext.ReqContext, instanceID, backupID, restoreID string) (*Restore, error) {
-	return nil, errNotImplemented
+// applyChanges creates, updates or deletes the changed objects. If a change fails, the changes made so far are reverted.
+func (h APIHandler) applyChanges(rctx *reqcontext.ReqContext, changes []objectChange) error {
+	for i, c := range changes {
+		var err error
+		switch {
+		case c.previous == nil:
+			err = h.client.Create(rctx.Context, c.desired)
+		case c.desired == nil:
+			err = client.IgnoreNotFound(h.client.Delete(rctx.Context, c.previous))
+		default:
+			err = h.client.Update(rctx.Context, c.desired)
+		}
+		if err != nil {
+			h.revertChanges(rctx, changes[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// revertChanges restores the previous state of the changed objects, the most recent change first.
+// Failures are only logged, the error of the change which failed is the one returned to the client.
+func (h APIHandler) revertChanges(rctx *reqcontext.ReqContext, changes []objectChange) {
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		var err error
+		var restored *unstructured.Unstructured
+		switch {
+		case c.previous == nil:
+			restored = c.desired
+			err = client.IgnoreNotFound(h.client.Delete(rctx.Context, c.desired))
+		case c.desired == nil:
+			restored = c.previous.DeepCopy()
+			restored.SetResourceVersion("")
+			restored.SetUID("")
+			err = h.client.Create(rctx.Context, restored)
+		default:
+			restored = c.previous.DeepCopy()
+			restored.SetResourceVersion(c.desired.GetResourceVersion())
+			err = h.client.Update(rctx.Context, restored)
+		}
+		if err != nil {
+			rctx.Logger.Error("revert-service-definition", err, lager.Data{"kind": restored.GetKind(), "name": restored.GetName()})
+		}
+	}
+}
+
+// ServiceDefinitionRevisions lists the recorded revisions of the service definition.
+func (h APIHandler) ServiceDefinitionRevisions(rctx *reqcontext.ReqContext, id string) ([]ServiceDefinitionRevision, error) {
+	if h.config.Namespace == "" {
+		return nil, errRevisionsDisabled
+	}
+	return h.listRevisions(rctx, id)
+}
+
+// RollbackServiceDefinition applies the definition recorded in the given revision again.
+// The plans of the service are restored as they were in the revision: plans added since are removed,
+// or deprecated if instances still use them.
+func (h APIHandler) RollbackServiceDefinition(rctx *reqcontext.ReqContext, id string, revision int) (*ServiceDefinitionRevision, error) {
+	if h.config.Namespace == "" {
+		return nil, errRevisionsDisabled
+	}
+	cm := &corev1.ConfigMap{}
+	if err := h.client.Get(rctx.Context, types.NamespacedName{Namespace: h.config.Namespace, Name: revisionName(id, revision)}, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, errRevisionDoesNotExist
+		}
+		return nil, err
+	}
+	r, err := revisionFromConfigMap(cm)
+	if err != nil {
+		return nil, err
+	}
+	if r.ServiceID != id {
+		return nil, errRevisionDoesNotExist
+	}
+
+	return h.applyServiceDefinitionRequest(rctx, r.Definition, &revision)
 }
 
-// APIDocs is not implemented
-func (h APIHandler) APIDocs(rctx *reqcontext.ReqContext, instanceID string) (string, error) {
-	return "", errNotImplemented
+// recordRevision records the definition as a new revision, authored by the originating identity of the request,
+// and removes the oldest revisions exceeding maxRevisions.
+// No revision is recorded if the definition didn't change, in which case the latest revision is returned.
+// Recording is skipped if no namespace to store revisions in is configured.
+// The flag tells whether a new revision has been recorded.
+func (h APIHandler) recordRevision(rctx *reqcontext.ReqContext, sd *ServiceDefinitionRequest, rollbackOf *int) (*ServiceDefinitionRevision, bool, error) {
+	if h.config.Namespace == "" {
+		return nil, false, nil
+	}
+	author, err := originatingIdentity(rctx.Context)
+	if err != nil {
+		rctx.Logger.Error("parse-originating-identity", err)
+	}
+
+	for attempt := 0; attempt < maxRevisionAttempts; attempt++ {
+		revisions, err := h.listRevisions(rctx, sd.ID)
+		if err != nil {
+			return nil, false, err
+		}
+		next := 1
+		var previous *ServiceDefinitionRevision
+		if len(revisions) > 0 {
+			previous = &revisions[len(revisions)-1]
+			next = previous.Revision + 1
+		}
+
+		var previousDefinition *ServiceDefinitionRequest
+		if previous != nil {
+			previousDefinition = previous.Definition
+			diff, err := definitionDiff(previousDefinition, sd)
+			if err != nil {
+				return nil, false, err
+			}
+			if string(diff) == "[]" && rollbackOf == nil {
+				return previous, false, nil
+			}
+		}
+
+		cm, err := newRevisionConfigMap(h.config.Namespace, next, sd, previousDefinition, author, rollbackOf)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := h.client.Create(rctx.Context, cm); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			return nil, false, err
+		}
+		rctx.Logger.Info("service-definition-revision-recorded", lager.Data{"service-id": sd.ID, "revision": next})
+
+		if excess := len(revisions) + 1 - maxRevisions; excess > 0 {
+			for _, old := range revisions[:excess] {
+				h.removeRevision(rctx, sd.ID, old.Revision)
+			}
+		}
+		r, err := revisionFromConfigMap(cm)
+		return r, true, err
+	}
+	return nil, false, fmt.Errorf("unable to record revision of service %q after %d attempts", sd.ID, maxRevisionAttempts)
+}
+
+// removeRevision deletes a recorded revision, failures are only logged.
+func (h APIHandler) removeRevision(rctx *reqcontext.ReqContext, id string, revision int) {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: h.config.Namespace, Name: revisionName(id, revision)}}
+	if err := h.client.Delete(rctx.Context, cm); client.IgnoreNotFound(err) != nil {
+		rctx.Logger.Error("remove-service-definition-revision", err, lager.Data{"service-id": id, "revision": revision})
+		return
+	}
+	rctx.Logger.Info("service-definition-revision-removed", lager.Data{"service-id": id, "revision": revision})
+}
+
+// listRevisions returns the revisions of the service definition, oldest first.
+func (h APIHandler) listRevisions(rctx *reqcontext.ReqContext, id string) ([]ServiceDefinitionRevision, error) {
+	cms := &corev1.ConfigMapList{}
+	err := h.client.List(rctx.Context, cms,
+		client.InNamespace(h.config.Namespace),
+		client.MatchingLabels{crossplane.ServiceIDLabel: id},
+		client.HasLabels{RevisionLabel},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return revisionsFromConfigMaps(cms.Items)
+}
+
+func errServiceDefinitionUnprocessable(err error) error {
+	return apiresponses.NewFailureResponseBuilder(err, http.StatusUnprocessableEntity, "service-definition-unprocessable").
+		WithErrorKey("ServiceDefinitionUnprocessable").
+		Build()
+}
+
+func errServiceDefinitionConflict(err error) error {
+	return apiresponses.NewFailureResponseBuilder(err, http.StatusConflict, "service-definition-conflict").
+		WithErrorKey("ServiceDefinitionConflict").
+		Build()
+}
+
+// DeleteServiceDefinition removes the service or plan with the given ID.
+// A service is removed by removing its labels from its CompositeResourceDefinition and deleting the
+// compositions of its plans, a plan by deleting its composition.
+// Services and plans still used by instances are kept.
+func (h APIHandler) DeleteServiceDefinition(rctx *reqcontext.ReqContext, id string) error {
+	xrds := newList(compositeResourceDefinitionGVK)
+	if err := h.client.List(rctx.Context, xrds, client.MatchingLabels{crossplane.ServiceIDLabel: id}); err != nil {
+		return err
+	}
+	if len(xrds.Items) > 0 {
+		return h.deleteService(rctx, &xrds.Items[0])
+	}
+
+	comp := newComposition(id)
+	if err := h.client.Get(rctx.Context, client.ObjectKeyFromObject(comp), comp); err != nil {
+		if apierrors.IsNotFound(err) {
+			return errServiceDefinitionDoesNotExist
+		}
+		return err
+	}
+	serviceID, ok := comp.GetLabels()[crossplane.ServiceIDLabel]
+	if !ok {
+		return errServiceDefinitionDoesNotExist
+	}
+	return h.deletePlan(rctx, serviceID, comp)
+}
+
+func (h APIHandler) deleteService(rctx *reqcontext.ReqContext, xrd *unstructured.Unstructured) error {
+	serviceID := xrd.GetLabels()[crossplane.ServiceIDLabel]
+	composites, err := h.listComposites(rctx, xrd)
+	if err != nil {
+		return err
+	}
+	if ids := usedByInstances(composites, func(c *unstructured.Unstructured) bool {
+		return c.GetLabels()[crossplane.ServiceIDLabel] == serviceID
+	}); len(ids) > 0 {
+		return errServiceDefinitionInUse(fmt.Errorf("service %q is still used by instances %s", serviceID, strings.Join(ids, ", ")))
+	}
+
+	plans := newList(compositionGVK)
+	if err := h.client.List(rctx.Context, plans, client.MatchingLabels{crossplane.ServiceIDLabel: serviceID}); err != nil {
+		return err
+	}
+	for i := range plans.Items {
+		if err := h.client.Delete(rctx.Context, &plans.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	removeServiceDefinition(xrd)
+	if err := h.client.Update(rctx.Context, xrd); err != nil {
+		return err
+	}
+	rctx.Logger.Info("service-definition-deleted", lager.Data{"service-id": serviceID, "plans": len(plans.Items)})
+	return nil
+}
+
+func (h APIHandler) deletePlan(rctx *reqcontext.ReqContext, serviceID string, comp *unstructured.Unstructured) error {
+	xrds := newList(compositeResourceDefinitionGVK)
+	if err := h.client.List(rctx.Context, xrds, client.MatchingLabels{crossplane.ServiceIDLabel: serviceID}); err != nil {
+		return err
+	}
+	if len(xrds.Items) > 0 {
+		composites, err := h.listComposites(rctx, &xrds.Items[0])
+		if err != nil {
+			return err
+		}
+		if ids := usedByInstances(composites, func(c *unstructured.Unstructured) bool {
+			return compositionName(c) == comp.GetName()
+		}); len(ids) > 0 {
+			return errServiceDefinitionInUse(fmt.Errorf("plan %q is still used by instances %s", comp.GetName(), strings.Join(ids, ", ")))
+		}
+	}
+
+	if err := h.client.Delete(rctx.Context, comp); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	rctx.Logger.Info("plan-definition-deleted", lager.Data{"service-id": serviceID, "plan-id": comp.GetName()})
+	return nil
+}
+
+// listComposites lists all composites defined by the given CompositeResourceDefinition.
+func (h APIHandler) listComposites(rctx *reqcontext.ReqContext, xrd *unstructured.Unstructured) ([]unstructured.Unstructured, error) {
+	gvk, err := compositeGVK(xrd)
+	if err != nil {
+		return nil, err
+	}
+	composites := newList(gvk)
+	if err := h.client.List(rctx.Context, composites); err != nil {
+		return nil, err
+	}
+	return composites.Items, nil
+}
+
+func errServiceDefinitionInUse(err error) error {
+	return apiresponses.NewFailureResponseBuilder(err, http.StatusConflict, "service-definition-in-use").
+		WithErrorKey("ServiceDefinitionInUse").
+		Build()
+}
+
+// CreateBackup starts a job taking a backup of the instance.
+func (h APIHandler) CreateBackup(rctx *reqcontext.ReqContext, instanceID string, b *BackupRequest) (*Backup, error) {
+	instance, cluster, err := h.findBackupInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := newBackupJob(instance, cluster, h.config, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := h.client.Create(rctx.Context, job); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil, errBackupInProgress
+		}
+		return nil, err
+	}
+	rctx.Logger.Info("backup-started", lager.Data{"backup-id": job.Name})
+
+	backup := backupFromJob(job, nil)
+	return &backup, nil
+}
+
+// findBackupInstance returns the instance with the given ID and the instance holding its data.
+func (h APIHandler) findBackupInstance(rctx *reqcontext.ReqContext, instanceID string) (*crossplane.Instance, *crossplane.Instance, error) {
+	if !h.config.BackupsEnabled() {
+		return nil, nil, errBackupsDisabled
+	}
+
+	instance, exists, err := h.findInstance(rctx, instanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, apiresponses.ErrInstanceDoesNotExist
+	}
+
+	cluster, err := h.backupCluster(rctx, instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	return instance, cluster, nil
+}
+
+// backupCluster returns the instance holding the data of the given instance.
+// Backups of MariaDB databases are taken from the Galera cluster they are part of.
+func (h APIHandler) backupCluster(rctx *reqcontext.ReqContext, instance *crossplane.Instance) (*crossplane.Instance, error) {
+	switch instance.Labels.ServiceName {
+	case crossplane.RedisService, crossplane.MariaDBService:
+		return instance, nil
+	case crossplane.MariaDBDatabaseService:
+		return h.getGaleraClusterFromDB(rctx, instance)
+	default:
+		return nil, errBackupNotSupported(instance.Labels.ServiceName)
+	}
+}
+
+func errBackupNotSupported(service crossplane.ServiceName) error {
+	return apiresponses.NewFailureResponseBuilder(
+		fmt.Errorf("backups are not supported for service %q", service),
+		http.StatusUnprocessableEntity,
+		"backup-not-supported").
+		WithErrorKey("BackupNotSupported").
+		Build()
+}
+
+// DeleteBackup starts a job removing the backup from the backup repository and deletes the backup job.
+// Backups used by a running restore can't be deleted.
+func (h APIHandler) DeleteBackup(rctx *reqcontext.ReqContext, instanceID, backupID string) error {
+	instance, cluster, err := h.findBackupInstance(rctx, instanceID)
+	if err != nil {
+		return err
+	}
+
+	job, err := h.backupJob(rctx, instance, cluster, backupID)
+	if err != nil {
+		return err
+	}
+
+	inUse, err := h.restoreInProgress(rctx, client.MatchingLabels{
+		OperationLabel: operationRestore,
+		BackupIDLabel:  backupID,
+	})
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return errBackupInUse
+	}
+	// Pruning a running backup would race with it writing its data.
+	if s := jobStatus(job); s == OperationPending || s == OperationRunning {
+		return errBackupRunning
+	}
+
+	// Failed backups might have stored data as well, which is why they are always pruned.
+	var snapshot string
+	r, err := h.jobResult(rctx, job)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		snapshot = r.Snapshot
+	}
+	if err := pruneBackup(rctx.Context, h.client, job, snapshot); err != nil {
+		return err
+	}
+	rctx.Logger.Info("backup-prune-started", lager.Data{"snapshot": snapshot})
+	return nil
+}
+
+// Backup returns the backup with the given ID.
+func (h APIHandler) Backup(rctx *reqcontext.ReqContext, instanceID, backupID string) (*Backup, error) {
+	instance, cluster, err := h.findBackupInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := h.backupJob(rctx, instance, cluster, backupID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := h.jobResult(rctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	backup := backupFromJob(job, result)
+	return &backup, nil
+}
+
+// ListBackups lists all backups of the instance, the most recent first.
+// For MariaDB instances the window point-in-time recovery is possible for is included.
+func (h APIHandler) ListBackups(rctx *reqcontext.ReqContext, instanceID string) (*BackupList, error) {
+	instance, cluster, err := h.findBackupInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, err := operationNamespace(cluster)
+	if err != nil {
+		return nil, err
+	}
+	selector := client.MatchingLabels{
+		crossplane.InstanceIDLabel: instance.ID(),
+		OperationLabel:             operationBackup,
+	}
+
+	jobs := &batchv1.JobList{}
+	if err := h.client.List(rctx.Context, jobs, client.InNamespace(namespace), selector); err != nil {
+		return nil, err
+	}
+	results, err := h.jobResults(rctx, namespace, selector, jobs.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]Backup, 0, len(jobs.Items))
+	for i := range jobs.Items {
+		backups = append(backups, backupFromJob(&jobs.Items[i], results[jobs.Items[i].Name]))
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+
+	list := &BackupList{Backups: backups}
+	if h.pointInTimeRecoverySupported(cluster) {
+		list.RecoveryWindow = recoveryWindow(backups, h.config.BinlogRetention, time.Now())
+	}
+	return list, nil
+}
+
+// pointInTimeRecoverySupported returns true if the given cluster can be recovered to any point in time
+// by replaying its binary logs.
+func (h APIHandler) pointInTimeRecoverySupported(cluster *crossplane.Instance) bool {
+	return cluster.Labels.ServiceName == crossplane.MariaDBService && h.config.BinlogRetention > 0
+}
+
+// backupJob returns the job which has taken the backup with the given ID.
+func (h APIHandler) backupJob(rctx *reqcontext.ReqContext, instance, cluster *crossplane.Instance, backupID string) (*batchv1.Job, error) {
+	namespace, err := operationNamespace(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &batchv1.Job{}
+	if err := h.client.Get(rctx.Context, client.ObjectKey{Namespace: namespace, Name: backupID}, job); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, errBackupDoesNotExist
+		}
+		return nil, err
+	}
+	if job.Labels[crossplane.InstanceIDLabel] != instance.ID() || job.Labels[OperationLabel] != operationBackup {
+		return nil, errBackupDoesNotExist
+	}
+	return job, nil
+}
+
+// jobResults returns the results of the jobs, keyed by the job name. The pods of the jobs are selected by the selector.
+// Results which haven't been recorded on the jobs yet are read from the terminated pods and recorded.
+func (h APIHandler) jobResults(rctx *reqcontext.ReqContext, namespace string, selector client.MatchingLabels, jobs []batchv1.Job) (map[string]*jobResult, error) {
+	results := make(map[string]*jobResult, len(jobs))
+	unrecorded := map[string]*batchv1.Job{}
+	for i := range jobs {
+		if r := recordedJobResult(&jobs[i]); r != nil {
+			results[jobs[i].Name] = r
+			continue
+		}
+		unrecorded[jobs[i].Name] = &jobs[i]
+	}
+	if len(unrecorded) == 0 {
+		return results, nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := h.client.List(rctx.Context, pods, client.InNamespace(namespace), selector); err != nil {
+		return nil, err
+	}
+	for name, r := range podResults(pods.Items) {
+		job, ok := unrecorded[name]
+		if !ok {
+			continue
+		}
+		results[name] = r
+		if err := recordJobResult(rctx.Context, h.client, job, r); err != nil {
+			rctx.Logger.Error("record-job-result", err, lager.Data{"job": name})
+		}
+	}
+	return results, nil
+}
+
+// jobResult returns the result of the job, nil if its pod hasn't terminated yet.
+func (h APIHandler) jobResult(rctx *reqcontext.ReqContext, job *batchv1.Job) (*jobResult, error) {
+	jobs := []batchv1.Job{*job}
+	results, err := h.jobResults(rctx, job.Namespace, client.MatchingLabels{batchv1.JobNameLabel: job.Name}, jobs)
+	if err != nil {
+		return nil, err
+	}
+	*job = jobs[0]
+	return results[job.Name], nil
+}
+
+// BackupSchedule returns the backup schedule of the instance.
+// The schedule is empty if there are no scheduled backups.
+func (h APIHandler) BackupSchedule(rctx *reqcontext.ReqContext, instanceID string) (*BackupSchedule, error) {
+	instance, cluster, err := h.findBackupInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := scheduleFromInstance(instance)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return &BackupSchedule{}, nil
+	}
+
+	namespace, err := operationNamespace(cluster)
+	if err != nil {
+		return nil, err
+	}
+	cj := &batchv1.CronJob{}
+	err = h.client.Get(rctx.Context, client.ObjectKey{Namespace: namespace, Name: scheduleName(instance.ID())}, cj)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if cj.Status.LastScheduleTime != nil {
+		s.LastScheduleTime = &cj.Status.LastScheduleTime.Time
+	}
+	return s, nil
+}
+
+// SetBackupSchedule stores the schedule on the composite of the instance and creates, updates
+// or removes the cron job taking the scheduled backups.
+func (h APIHandler) SetBackupSchedule(rctx *reqcontext.ReqContext, instanceID string, s *BackupSchedule) (*BackupSchedule, error) {
+	if err := validateSchedule(s); err != nil {
+		return nil, apiresponses.NewFailureResponseBuilder(err, http.StatusUnprocessableEntity, "invalid-backup-schedule").
+			WithErrorKey("InvalidBackupSchedule").
+			Build()
+	}
+	s.LastScheduleTime = nil
+
+	instance, cluster, err := h.findBackupInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Schedule == "" {
+		namespace, err := operationNamespace(cluster)
+		if err != nil {
+			return nil, err
+		}
+		// The backups taken by the cron job must outlive it, garbage collecting them wouldn't prune their stored data.
+		cj := &batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: scheduleName(instance.ID())}}
+		err = h.client.Delete(rctx.Context, cj, client.PropagationPolicy(metav1.DeletePropagationOrphan))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		if err := h.retainScheduledBackups(rctx, instance, namespace); err != nil {
+			return nil, err
+		}
+		if err := h.annotateInstance(rctx, instance, BackupScheduleAnnotation, nil); err != nil {
+			return nil, err
+		}
+		rctx.Logger.Info("backup-schedule-removed")
+		return s, nil
+	}
+
+	desired, err := newBackupCronJob(instance, cluster, s, h.config)
+	if err != nil {
+		return nil, err
+	}
+	cj := &batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Namespace: desired.Namespace, Name: desired.Name}}
+	_, err = controllerutil.CreateOrUpdate(rctx.Context, h.client, cj, func() error {
+		cj.Labels = desired.Labels
+		cj.Annotations = desired.Annotations
+		cj.OwnerReferences = desired.OwnerReferences
+		cj.Spec = desired.Spec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	annotation := string(a)
+	if err := h.annotateInstance(rctx, instance, BackupScheduleAnnotation, &annotation); err != nil {
+		return nil, err
+	}
+	rctx.Logger.Info("backup-schedule-set", lager.Data{"schedule": s.Schedule})
+	return s, nil
+}
+
+// retainScheduledBackups applies the retention of manual backups to the scheduled backups of the instance,
+// which are no longer covered by the retention policy of a schedule.
+// Without a retention they are kept until they get deleted, like manual backups.
+func (h APIHandler) retainScheduledBackups(rctx *reqcontext.ReqContext, instance *crossplane.Instance, namespace string) error {
+	if h.config.BackupRetention <= 0 {
+		return nil
+	}
+	jobs := &batchv1.JobList{}
+	err := h.client.List(rctx.Context, jobs, client.InNamespace(namespace), client.MatchingLabels{
+		OperationLabel:             operationBackup,
+		BackupTypeLabel:            string(BackupScheduled),
+		crossplane.InstanceIDLabel: instance.ID(),
+	})
+	if err != nil {
+		return err
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if _, ok := job.Annotations[RetentionAnnotation]; ok {
+			continue
+		}
+		patch := client.MergeFrom(job.DeepCopy())
+		metav1.SetMetaDataAnnotation(&job.ObjectMeta, RetentionAnnotation, h.config.BackupRetention.String())
+		if err := h.client.Patch(rctx.Context, job, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annotateInstance sets an annotation on the composite of the instance, a nil value removes the annotation.
+func (h APIHandler) annotateInstance(rctx *reqcontext.ReqContext, instance *crossplane.Instance, key string, value *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(instance.Composite.GetObjectKind().GroupVersionKind())
+	u.SetName(instance.Composite.GetName())
+	return h.client.Patch(rctx.Context, u, client.RawPatch(types.MergePatchType, patch))
+}
+
+// RestoreBackup starts a job restoring the backup either into the instance it has been taken of
+// or into a new instance provisioned by the platform.
+func (h APIHandler) RestoreBackup(rctx *reqcontext.ReqContext, instanceID, backupID string, r *RestoreRequest) (*Restore, error) {
+	source, sourceCluster, err := h.findBackupInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	backupJob, err := h.backupJob(rctx, source, sourceCluster, backupID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := h.jobResult(rctx, backupJob)
+	if err != nil {
+		return nil, err
+	}
+	if jobStatus(backupJob) != OperationSucceeded || result == nil || result.Snapshot == "" {
+		return nil, errBackupNotRestorable
+	}
+
+	if r.TargetTime != nil {
+		if !h.pointInTimeRecoverySupported(sourceCluster) {
+			return nil, errPointInTimeRecoveryNotSupported
+		}
+		now := time.Now()
+		backup := backupFromJob(backupJob, result)
+		if !recoverableFrom(backup, h.config.BinlogRetention, now) || r.TargetTime.Before(*backup.FinishedAt) || r.TargetTime.After(now) {
+			return nil, apiresponses.NewFailureResponseBuilder(
+				fmt.Errorf("target time %s is not recoverable from backup %q", r.TargetTime.Format(time.RFC3339), backupID),
+				http.StatusUnprocessableEntity,
+				"target-time-not-recoverable").
+				WithErrorKey("TargetTimeNotRecoverable").
+				Build()
+		}
+	}
+
+	instance, cluster := source, sourceCluster
+	switch r.Mode {
+	case "", RestoreInPlace:
+		inProgress, err := h.restoreInProgress(rctx, client.MatchingLabels{
+			OperationLabel:             operationRestore,
+			crossplane.InstanceIDLabel: instance.ID(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if inProgress {
+			return nil, errRestoreInProgress
+		}
+	case RestoreNewInstance:
+		instance, cluster, err = h.restoreTargetInstance(rctx, source, r.TargetInstanceID)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, apiresponses.NewFailureResponse(fmt.Errorf("unknown restore mode %q", r.Mode), http.StatusBadRequest, "invalid-restore-mode")
+	}
+
+	job, err := newRestoreJob(source, instance, cluster, backupID, result.Snapshot, r.TargetTime, h.config, time.Now())
+	if err == nil {
+		err = h.client.Create(rctx.Context, job)
+	}
+	if err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil, errRestoreInProgress
+		}
+		return nil, err
+	}
+	rctx.Logger.Info("restore-started", lager.Data{"restore-id": job.Name, "target-instance-id": instance.ID()})
+
+	restore := restoreFromJob(job, nil)
+	return &restore, nil
+}
+
+// restoreTargetInstance returns the instance provisioned by the platform to restore a backup of the source into
+// and the instance holding its data. It must be another instance of the service of the source with a plan
+// at least as large as the one of the source, and no restore into it may be running.
+func (h APIHandler) restoreTargetInstance(rctx *reqcontext.ReqContext, source *crossplane.Instance, targetID string) (*crossplane.Instance, *crossplane.Instance, error) {
+	if targetID == "" {
+		return nil, nil, errInvalidRestoreTarget(errors.New("target instance is required to restore into a new instance"))
+	}
+	if targetID == source.ID() {
+		return nil, nil, errInvalidRestoreTarget(errors.New("target instance must not be the instance the backup has been taken of"))
+	}
+	instance, exists, err := h.findInstance(rctx, targetID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, errInvalidRestoreTarget(fmt.Errorf("target instance %q does not exist", targetID))
+	}
+	if instance.Labels.ServiceID != source.Labels.ServiceID {
+		return nil, nil, errInvalidRestoreTarget(fmt.Errorf("target instance %q is not of the service of the backup", targetID))
+	}
+	ref := instance.Composite.GetCompositionReference()
+	if ref == nil {
+		return nil, nil, fmt.Errorf("instance %q has no plan", targetID)
+	}
+	if err := h.checkRestorePlan(rctx, source, ref.Name); err != nil {
+		return nil, nil, err
+	}
+
+	inProgress, err := h.restoreInProgress(rctx, client.MatchingLabels{
+		OperationLabel:             operationRestore,
+		crossplane.InstanceIDLabel: instance.ID(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if inProgress {
+		return nil, nil, errRestoreInProgress
+	}
+
+	cluster, err := h.backupCluster(rctx, instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	return instance, cluster, nil
+}
+
+// checkRestorePlan requires the plan a backup of the source is restored into to be at least as large as the plan
+// of the source. That's the plan of the source, or a plan of the same service the source could be updated to
+// by one or more steps of the plan update size rules.
+func (h APIHandler) checkRestorePlan(rctx *reqcontext.ReqContext, source *crossplane.Instance, planID string) error {
+	ref := source.Composite.GetCompositionReference()
+	if ref == nil {
+		return fmt.Errorf("instance %q has no plan", source.ID())
+	}
+	if ref.Name == planID {
+		return nil
+	}
+
+	sourcePlan := newComposition(ref.Name)
+	if err := h.client.Get(rctx.Context, client.ObjectKeyFromObject(sourcePlan), sourcePlan); err != nil {
+		return err
+	}
+	plan := newComposition(planID)
+	if err := h.client.Get(rctx.Context, client.ObjectKeyFromObject(plan), plan); err != nil {
+		if apierrors.IsNotFound(err) {
+			return errInvalidRestoreTarget(fmt.Errorf("plan %q does not exist", planID))
+		}
+		return err
+	}
+	if plan.GetLabels()[crossplane.ServiceIDLabel] != source.Labels.ServiceID {
+		return errInvalidRestoreTarget(fmt.Errorf("plan %q is not a plan of the service of the backup", planID))
+	}
+
+	from, to := sourcePlan.GetLabels()[crossplane.PlanNameLabel], plan.GetLabels()[crossplane.PlanNameLabel]
+	if from != to && !sizeReachable(h.config.PlanUpdateSizeRule, from, to) {
+		return errInvalidRestoreTarget(fmt.Errorf("plan %q is smaller than the plan of the instance the backup has been taken of", planID))
+	}
+	return nil
+}
+
+// sizeReachable returns true if the size rule, such as "small>medium|medium>large", allows to update a plan
+// from one size to the other in one or more steps.
+func sizeReachable(rule, from, to string) bool {
+	next := map[string][]string{}
+	for _, transition := range strings.Split(rule, "|") {
+		sizes := strings.Split(transition, ">")
+		for i := 0; i+1 < len(sizes); i++ {
+			a, b := strings.TrimSpace(sizes[i]), strings.TrimSpace(sizes[i+1])
+			next[a] = append(next[a], b)
+		}
+	}
+
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 {
+		size := queue[0]
+		queue = queue[1:]
+		for _, n := range next[size] {
+			if n == to {
+				return true
+			}
+			if !seen[n] {
+				seen[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+	return false
+}
+
+func errInvalidRestoreTarget(err error) error {
+	return apiresponses.NewFailureResponseBuilder(err, http.StatusUnprocessableEntity, "invalid-restore-target").
+		WithErrorKey("InvalidRestoreTarget").
+		Build()
+}
+
+// RestoreStatus returns the status of the restore with the given ID.
+func (h APIHandler) RestoreStatus(rctx *reqcontext.ReqContext, instanceID, backupID, restoreID string) (*Restore, error) {
+	if _, _, err := h.findBackupInstance(rctx, instanceID); err != nil {
+		return nil, err
+	}
+
+	// Restores into new instances run next to the connection secret of the new instance,
+	// which is why they are looked up by their labels in all namespaces.
+	jobs := &batchv1.JobList{}
+	err := h.client.List(rctx.Context, jobs, client.MatchingLabels{
+		OperationLabel:        operationRestore,
+		SourceInstanceIDLabel: instanceID,
+		BackupIDLabel:         backupID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if job.Name != restoreID {
+			continue
+		}
+
+		result, err := h.jobResult(rctx, job)
+		if err != nil {
+			return nil, err
+		}
+		restore := restoreFromJob(job, result)
+		return &restore, nil
+	}
+	return nil, errRestoreDoesNotExist
+}
+
+// restoreInProgress returns true if any of the restore jobs matching the selector has not finished yet.
+func (h APIHandler) restoreInProgress(rctx *reqcontext.ReqContext, selector client.MatchingLabels) (bool, error) {
+	restores := &batchv1.JobList{}
+	if err := h.client.List(rctx.Context, restores, selector); err != nil {
+		return false, err
+	}
+	for i := range restores.Items {
+		if s := jobStatus(&restores.Items[i]); s == OperationPending || s == OperationRunning {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// APIDocs returns the OpenAPI document of all routes of the custom API.
+func (h APIHandler) APIDocs(rctx *reqcontext.ReqContext) (*OpenAPI, error) {
+	return newOpenAPI(routes)
+}
+
+// InstanceAPIDocs returns the OpenAPI document of the custom API endpoints available for the service of the instance.
+// The description explains how to connect to the instance. The endpoints are left out while the instance isn't ready.
+func (h APIHandler) InstanceAPIDocs(rctx *reqcontext.ReqContext, instanceID string) (*OpenAPI, error) {
+	instance, exists, err := h.findInstance(rctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apiresponses.ErrInstanceDoesNotExist
+	}
+
+	endpoints, err := h.endpoints(rctx, instance)
+	if err != nil {
+		rctx.Logger.Info("api-docs-without-endpoints", lager.Data{"error": err.Error()})
+		endpoints = nil
+	}
+	return newInstanceOpenAPI(instanceID, instance.Labels.ServiceName, endpoints)
 }
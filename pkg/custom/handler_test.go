@@ -9,12 +9,14 @@ import (
 	"testing"
 
 	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
 	"github.com/pivotal-cf/brokerapi/v8/middlewares"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
 	"github.com/vshn/crossplane-service-broker/pkg/integration"
 	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -24,7 +26,7 @@ func TestAPIHandler_Endpoints(t *testing.T) {
 		ctx        context.Context
 		instanceID string
 	}
-	ctx := context.WithValue(context.TODO(), middlewares.CorrelationIDKey, "corrid")
+	ctx := context.WithValue(adminContext(), middlewares.CorrelationIDKey, "corrid")
 
 	tests := []struct {
 		name      string
@@ -49,7 +51,7 @@ func TestAPIHandler_Endpoints(t *testing.T) {
 				return nil, objs
 			},
 			want:    nil,
-			wantErr: errors.New(`unable to get secret: secrets "1-1-1" not found`),
+			wantErr: errors.New(`instance "1-1-1" is not yet ready`),
 		},
 		{
 			name: "creates a redis instance and gets the endpoints",
@@ -78,14 +80,17 @@ func TestAPIHandler_Endpoints(t *testing.T) {
 			},
 			want: []Endpoint{
 				{
+					Name:        EndpointNameRedis,
 					Destination: "localhost",
 					Ports:       "1234",
 					Protocol:    "tcp",
 				},
 				{
-					Destination: "localhost",
-					Ports:       "21234",
-					Protocol:    "tcp",
+					Name:           EndpointNameSentinel,
+					Destination:    "localhost",
+					Ports:          "21234",
+					Protocol:       "tcp",
+					SentinelMaster: &SentinelMaster{Name: "mymaster", Status: SentinelMasterPending},
 				},
 			},
 			wantErr: nil,
@@ -124,7 +129,7 @@ func TestAPIHandler_Endpoints(t *testing.T) {
 	require.NoError(t, err, "unable to setup integration test manager")
 	defer m.Cleanup()
 
-	handler := NewAPIHandler(cp, logger)
+	handler := NewAPIHandler(cp, m.GetClient(), nil, &Config{}, logger)
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -148,3 +153,105 @@ func TestAPIHandler_Endpoints(t *testing.T) {
 		})
 	}
 }
+
+func TestAPIHandler_CreateBackup(t *testing.T) {
+	ctx := context.WithValue(adminContext(), middlewares.CorrelationIDKey, "corrid")
+
+	tests := []struct {
+		name       string
+		instanceID string
+		config     *Config
+		wantErr    error
+		resources  func() []client.Object
+	}{
+		{
+			name:       "requires backups to be configured",
+			instanceID: "1-1-1",
+			config:     &Config{},
+			resources: func() []client.Object {
+				servicePlan := integration.NewTestServicePlan("1", "1-1", crossplane.RedisService)
+				return []client.Object{
+					integration.NewTestService("1", crossplane.RedisService),
+					servicePlan.Composition,
+					integration.NewTestInstance("1-1-1", servicePlan, crossplane.RedisService, "", ""),
+				}
+			},
+			wantErr: errBackupsDisabled,
+		},
+		{
+			name:       "requires instance to exist",
+			instanceID: "1-1-2",
+			config:     &Config{BackupImage: "backup:latest", BackupSecret: "backup"},
+			resources: func() []client.Object {
+				servicePlan := integration.NewTestServicePlan("1", "1-1", crossplane.RedisService)
+				return []client.Object{
+					integration.NewTestService("1", crossplane.RedisService),
+					servicePlan.Composition,
+					integration.NewTestInstance("1-1-1", servicePlan, crossplane.RedisService, "", ""),
+				}
+			},
+			wantErr: apiresponses.ErrInstanceDoesNotExist,
+		},
+		{
+			name:       "starts a backup job of a redis instance",
+			instanceID: "1-1-1",
+			config:     &Config{BackupImage: "backup:latest", BackupSecret: "backup"},
+			resources: func() []client.Object {
+				servicePlan := integration.NewTestServicePlan("1", "1-1", crossplane.RedisService)
+				return []client.Object{
+					integration.NewTestService("1", crossplane.RedisService),
+					servicePlan.Composition,
+					integration.NewTestInstance("1-1-1", servicePlan, crossplane.RedisService, "", ""),
+				}
+			},
+		},
+		{
+			name:       "starts a backup job of a mariadb database",
+			instanceID: "2-1-1",
+			config:     &Config{BackupImage: "backup:latest", BackupSecret: "backup"},
+			resources: func() []client.Object {
+				servicePlan := integration.NewTestServicePlan("1", "1-1", crossplane.MariaDBService)
+				dbServicePlan := integration.NewTestServicePlan("2", "2-1", crossplane.MariaDBDatabaseService)
+				return []client.Object{
+					integration.NewTestService("1", crossplane.MariaDBService),
+					integration.NewTestService("2", crossplane.MariaDBDatabaseService),
+					servicePlan.Composition,
+					dbServicePlan.Composition,
+					integration.NewTestInstance("1-1-1", servicePlan, crossplane.MariaDBService, "", ""),
+					integration.NewTestInstance("2-1-1", dbServicePlan, crossplane.MariaDBDatabaseService, "", "1-1-1"),
+				}
+			},
+		},
+	}
+
+	m, logger, cp, err := integration.SetupManager(t)
+	require.NoError(t, err, "unable to setup integration test manager")
+	defer m.Cleanup()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := tt.resources()
+			require.NoError(t, integration.CreateObjects(ctx, objs)(m.GetClient()))
+			defer func() {
+				require.NoError(t, integration.RemoveObjects(ctx, objs)(m.GetClient()))
+			}()
+
+			handler := NewAPIHandler(cp, m.GetClient(), nil, tt.config, logger)
+			got, err := handler.CreateBackup(reqcontext.NewReqContext(ctx, logger, nil), tt.instanceID, &BackupRequest{})
+			if tt.wantErr != nil {
+				assert.EqualError(t, err, tt.wantErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, OperationPending, got.Status)
+
+			job := &batchv1.Job{}
+			require.NoError(t, m.GetClient().Get(ctx, client.ObjectKey{Namespace: integration.TestNamespace, Name: got.ID}, job))
+			defer func() {
+				require.NoError(t, m.GetClient().Delete(ctx, job))
+			}()
+			assert.Equal(t, tt.instanceID, job.Labels[crossplane.InstanceIDLabel])
+			assert.Equal(t, "backup:latest", job.Spec.Template.Spec.Containers[0].Image)
+		})
+	}
+}
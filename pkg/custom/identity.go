@@ -0,0 +1,93 @@
+package custom
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
+	"github.com/pivotal-cf/brokerapi/v8/middlewares"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+)
+
+// Keys of the originating identity value naming the organization and space a request is made in.
+// Platforms don't send them, callers of the custom API acting on behalf of a tenant add them.
+// As they are chosen by the caller, they only grant access to callers with the platform or broker credentials.
+const (
+	IdentityOrganizationKey = "organization_guid"
+	IdentitySpaceKey        = "space_guid"
+)
+
+var errCrossTenantAccess = apiresponses.NewFailureResponseBuilder(
+	errors.New("originating identity belongs to another tenant than the instance"),
+	http.StatusForbidden,
+	"cross-tenant-access").
+	WithErrorKey("Forbidden").
+	Build()
+
+// originatingIdentity returns the originating identity of the request, nil if the platform didn't pass one.
+func originatingIdentity(ctx context.Context) (*OriginatingIdentity, error) {
+	header, ok := ctx.Value(middlewares.OriginatingIdentityKey).(string)
+	if !ok || header == "" {
+		return nil, nil
+	}
+	return parseOriginatingIdentity(header)
+}
+
+// parseOriginatingIdentity parses the platform and the base64 encoded JSON value of the header.
+func parseOriginatingIdentity(header string) (*OriginatingIdentity, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("originating identity must consist of platform and value")
+	}
+	raw, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode originating identity: %w", err)
+	}
+	identity := &OriginatingIdentity{Platform: parts[0]}
+	if err := json.Unmarshal(raw, &identity.Value); err != nil {
+		return nil, fmt.Errorf("unable to decode originating identity: %w", err)
+	}
+	return identity, nil
+}
+
+// authorizeIdentity returns errCrossTenantAccess if the originating identity doesn't match the tenant the instance
+// was provisioned for. The identity must be of the platform the instance was provisioned on, an organization or
+// space, if named, must be the one of the instance.
+func authorizeIdentity(identity *OriginatingIdentity, instance *crossplane.Instance) error {
+	annotations := instance.Composite.GetAnnotations()
+	if p := annotations[PlatformAnnotation]; p != "" && p != identity.Platform {
+		return errCrossTenantAccess
+	}
+	if org := identity.stringValue(IdentityOrganizationKey); org != "" && org != annotations[OrganizationAnnotation] {
+		return errCrossTenantAccess
+	}
+	if space := identity.stringValue(IdentitySpaceKey); space != "" && space != annotations[SpaceAnnotation] {
+		return errCrossTenantAccess
+	}
+	return nil
+}
+
+// authorizeTenant returns an error unless the originating identity names the tenant the instance was provisioned for.
+// It decides for credentials which don't name a tenant themselves, which is why the identity must name an
+// organization and the instance must have recorded the platform and organization it was provisioned in.
+func authorizeTenant(identity *OriginatingIdentity, instance *crossplane.Instance) error {
+	annotations := instance.Composite.GetAnnotations()
+	if annotations[PlatformAnnotation] == "" || annotations[OrganizationAnnotation] == "" {
+		return errInstanceAccessDenied
+	}
+	if identity.stringValue(IdentityOrganizationKey) == "" {
+		return errMissingTenant
+	}
+	return authorizeIdentity(identity, instance)
+}
+
+// stringValue returns the value of the identity with the given key, empty if it isn't a string.
+func (i *OriginatingIdentity) stringValue(key string) string {
+	s, _ := i.Value[key].(string)
+	return s
+}
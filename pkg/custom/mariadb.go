@@ -0,0 +1,195 @@
+package custom
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/go-sql-driver/mysql"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mariaDBTimeout limits the time establishing a connection to a MariaDB instance may take.
+const mariaDBTimeout = 5 * time.Second
+
+// openMariaDB opens a connection pool to an endpoint of a Galera cluster using the credentials of its connection secret.
+// Connections use TLS if the endpoint requires it.
+func openMariaDB(connectionDetails *corev1.Secret, e Endpoint) (*sql.DB, error) {
+	addr, tlsConfig, err := dialTarget(e)
+	if err != nil {
+		return nil, err
+	}
+	cfg := mysql.NewConfig()
+	cfg.User = string(connectionDetails.Data[xrv1.ResourceCredentialsSecretUserKey])
+	cfg.Passwd = string(connectionDetails.Data[xrv1.ResourceCredentialsSecretPasswordKey])
+	cfg.Net = "tcp"
+	cfg.Addr = addr
+	cfg.Timeout = mariaDBTimeout
+	cfg.TLS = tlsConfig
+
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// queryMariaDBUsage returns the usage of a Galera cluster.
+// If a database is given, storage and connections are limited to that database.
+func queryMariaDBUsage(ctx context.Context, db *sql.DB, database string) (*MariaDBUsage, error) {
+	u := &MariaDBUsage{}
+
+	query := `SELECT table_schema, COALESCE(SUM(data_length + index_length), 0), COUNT(*)
+		FROM information_schema.tables
+		WHERE table_schema NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')`
+	args := []interface{}{}
+	if database != "" {
+		query += " AND table_schema = ?"
+		args = append(args, database)
+	}
+	query += " GROUP BY table_schema ORDER BY table_schema"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DatabaseUsage
+		if err := rows.Scan(&d.Name, &d.Size, &d.Tables); err != nil {
+			return nil, err
+		}
+		u.Databases = append(u.Databases, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if database != "" && len(u.Databases) == 0 {
+		// Databases without any tables don't show up in information_schema.tables.
+		u.Databases = []DatabaseUsage{{Name: database}}
+	}
+
+	if database != "" {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.processlist WHERE db = ?", database).Scan(&u.ActiveConnections)
+	} else {
+		var name string
+		err = db.QueryRowContext(ctx, "SHOW GLOBAL STATUS LIKE 'Threads_connected'").Scan(&name, &u.ActiveConnections)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.QueryRowContext(ctx, "SELECT @@max_connections").Scan(&u.MaxConnections); err != nil {
+		return nil, err
+	}
+
+	wsrep, err := queryStatus(ctx, db, "wsrep_%")
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := wsrep["wsrep_cluster_size"]; ok {
+		size, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse wsrep_cluster_size: %w", err)
+		}
+		u.Cluster = &GaleraStatus{
+			Size:       size,
+			Status:     wsrep["wsrep_cluster_status"],
+			LocalState: wsrep["wsrep_local_state_comment"],
+		}
+	}
+	return u, nil
+}
+
+// galeraNode is a node of a Galera cluster. The error is set if the node couldn't be queried.
+type galeraNode struct {
+	addr string
+	role string
+	err  error
+}
+
+// queryGaleraNodes lists the nodes of the Galera cluster the connection pool is connected to through the load balancer.
+// Each node is queried for its state, the node the load balancer sends the queries to is the writer.
+func queryGaleraNodes(ctx context.Context, lb *sql.DB, openNode func(addr string) (*sql.DB, error)) ([]galeraNode, error) {
+	cluster, err := queryStatus(ctx, lb, "wsrep_%")
+	if err != nil {
+		return nil, err
+	}
+	addrs := parseIncomingAddresses(cluster["wsrep_incoming_addresses"])
+	if len(addrs) == 0 {
+		return nil, errors.New("cluster doesn't report the addresses of its nodes")
+	}
+
+	nodes := make([]galeraNode, 0, len(addrs))
+	for _, addr := range addrs {
+		n := galeraNode{addr: addr, role: EndpointRoleUnavailable}
+		status, err := queryNodeStatus(ctx, addr, openNode)
+		if err != nil {
+			n.err = err
+		} else {
+			n.role = galeraNodeRole(status["wsrep_local_state_comment"], status["wsrep_gcomm_uuid"] == cluster["wsrep_gcomm_uuid"])
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func queryNodeStatus(ctx context.Context, addr string, openNode func(addr string) (*sql.DB, error)) (map[string]string, error) {
+	db, err := openNode(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return queryStatus(ctx, db, "wsrep_%")
+}
+
+// parseIncomingAddresses parses the comma separated addresses of wsrep_incoming_addresses.
+// Nodes which don't accept client connections are listed as "AUTO" and left out.
+func parseIncomingAddresses(s string) []string {
+	var addrs []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" && a != "AUTO" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// galeraNodeRole returns the role of a node given its wsrep_local_state_comment.
+func galeraNodeRole(state string, writer bool) string {
+	switch {
+	case state == "Synced" && writer:
+		return EndpointRoleWriter
+	case state == "Synced":
+		return EndpointRoleReader
+	case strings.HasPrefix(state, "Donor"):
+		return EndpointRoleDonor
+	case strings.HasPrefix(state, "Join"), strings.HasPrefix(state, "Waiting"):
+		return EndpointRoleSyncing
+	default:
+		return EndpointRoleUnavailable
+	}
+}
+
+// queryStatus returns the global status variables matching the pattern.
+func queryStatus(ctx context.Context, db *sql.DB, pattern string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SHOW GLOBAL STATUS LIKE ?", pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	status := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		status[name] = value
+	}
+	return status, rows.Err()
+}
@@ -0,0 +1,184 @@
+package custom
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIncomingAddresses(t *testing.T) {
+	assert.Equal(t, []string{"10.0.0.1:3306", "10.0.0.2:3306"}, parseIncomingAddresses("10.0.0.1:3306, AUTO,10.0.0.2:3306"))
+	assert.Empty(t, parseIncomingAddresses(""))
+}
+
+func TestGaleraNodeRole(t *testing.T) {
+	tests := []struct {
+		state  string
+		writer bool
+		want   string
+	}{
+		{state: "Synced", writer: true, want: EndpointRoleWriter},
+		{state: "Synced", want: EndpointRoleReader},
+		{state: "Donor/Desynced", want: EndpointRoleDonor},
+		{state: "Joining: receiving State Transfer", want: EndpointRoleSyncing},
+		{state: "Joined", want: EndpointRoleSyncing},
+		{state: "Initialized", want: EndpointRoleUnavailable},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, galeraNodeRole(tt.state, tt.writer), tt.state)
+	}
+}
+
+// fakeQuery is the result of the queries starting with the statement of a fakeDB.
+type fakeQuery struct {
+	statement string
+	args      []driver.Value
+	columns   []string
+	rows      [][]driver.Value
+	err       error
+}
+
+// fakeDB is a database/sql driver answering the queries it knows with fixed results.
+type fakeDB struct {
+	queries []fakeQuery
+}
+
+func (f *fakeDB) open() *sql.DB {
+	return sql.OpenDB(f)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return f, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+func (f *fakeDB) Prepare(string) (driver.Stmt, error)          { return nil, errors.New("not supported") }
+func (f *fakeDB) Close() error                                 { return nil }
+func (f *fakeDB) Begin() (driver.Tx, error)                    { return nil, errors.New("not supported") }
+
+func (f *fakeDB) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]driver.Value, 0, len(args))
+	for _, a := range args {
+		values = append(values, a.Value)
+	}
+	for _, q := range f.queries {
+		if strings.HasPrefix(strings.TrimSpace(query), q.statement) && fmt.Sprint(q.args) == fmt.Sprint(values) {
+			if q.err != nil {
+				return nil, q.err
+			}
+			return &fakeRows{columns: q.columns, rows: q.rows}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected query %q with %v", query, values)
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestQueryMariaDBUsage(t *testing.T) {
+	maxConnections := fakeQuery{statement: "SELECT @@max_connections", columns: []string{"max"}, rows: [][]driver.Value{{int64(100)}}}
+	wsrep := fakeQuery{
+		statement: "SHOW GLOBAL STATUS LIKE ?",
+		args:      []driver.Value{"wsrep_%"},
+		columns:   []string{"Variable_name", "Value"},
+		rows: [][]driver.Value{
+			{"wsrep_cluster_size", "3"},
+			{"wsrep_cluster_status", "Primary"},
+			{"wsrep_local_state_comment", "Synced"},
+		},
+	}
+
+	t.Run("cluster", func(t *testing.T) {
+		db := (&fakeDB{queries: []fakeQuery{
+			{
+				statement: "SELECT table_schema",
+				columns:   []string{"table_schema", "size", "tables"},
+				rows:      [][]driver.Value{{"db1", int64(2048), int64(3)}, {"db2", int64(0), int64(1)}},
+			},
+			{
+				statement: "SHOW GLOBAL STATUS LIKE 'Threads_connected'",
+				columns:   []string{"Variable_name", "Value"},
+				rows:      [][]driver.Value{{"Threads_connected", "7"}},
+			},
+			maxConnections,
+			wsrep,
+		}}).open()
+		defer db.Close()
+
+		u, err := queryMariaDBUsage(context.TODO(), db, "")
+		require.NoError(t, err)
+		assert.Equal(t, &MariaDBUsage{
+			Databases:         []DatabaseUsage{{Name: "db1", Size: 2048, Tables: 3}, {Name: "db2", Tables: 1}},
+			ActiveConnections: 7,
+			MaxConnections:    100,
+			Cluster:           &GaleraStatus{Size: 3, Status: "Primary", LocalState: "Synced"},
+		}, u)
+	})
+
+	t.Run("database without tables", func(t *testing.T) {
+		db := (&fakeDB{queries: []fakeQuery{
+			{statement: "SELECT table_schema", args: []driver.Value{"db1"}, columns: []string{"table_schema", "size", "tables"}},
+			{
+				statement: "SELECT COUNT(*) FROM information_schema.processlist",
+				args:      []driver.Value{"db1"},
+				columns:   []string{"count"},
+				rows:      [][]driver.Value{{int64(2)}},
+			},
+			maxConnections,
+			{statement: "SHOW GLOBAL STATUS LIKE ?", args: []driver.Value{"wsrep_%"}, columns: []string{"Variable_name", "Value"}},
+		}}).open()
+		defer db.Close()
+
+		u, err := queryMariaDBUsage(context.TODO(), db, "db1")
+		require.NoError(t, err)
+		assert.Equal(t, &MariaDBUsage{
+			Databases:         []DatabaseUsage{{Name: "db1"}},
+			ActiveConnections: 2,
+			MaxConnections:    100,
+		}, u)
+	})
+
+	t.Run("invalid cluster size", func(t *testing.T) {
+		invalid := wsrep
+		invalid.rows = [][]driver.Value{{"wsrep_cluster_size", "three"}}
+		db := (&fakeDB{queries: []fakeQuery{
+			{statement: "SELECT table_schema", columns: []string{"table_schema", "size", "tables"}},
+			{statement: "SHOW GLOBAL STATUS LIKE 'Threads_connected'", columns: []string{"Variable_name", "Value"}, rows: [][]driver.Value{{"Threads_connected", "1"}}},
+			maxConnections,
+			invalid,
+		}}).open()
+		defer db.Close()
+
+		_, err := queryMariaDBUsage(context.TODO(), db, "")
+		assert.ErrorContains(t, err, "unable to parse wsrep_cluster_size")
+	})
+
+	t.Run("query fails", func(t *testing.T) {
+		db := (&fakeDB{queries: []fakeQuery{
+			{statement: "SELECT table_schema", err: errors.New("connection refused")},
+		}}).open()
+		defer db.Close()
+
+		_, err := queryMariaDBUsage(context.TODO(), db, "")
+		assert.EqualError(t, err, "connection refused")
+	})
+}
@@ -0,0 +1,416 @@
+package custom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+)
+
+// openAPIVersion is the version of the OpenAPI specification the document follows.
+const openAPIVersion = "3.0.3"
+
+// OpenAPI is an OpenAPI 3 document.
+type OpenAPI struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security,omitempty"`
+}
+
+// OpenAPIInfo describes the API.
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// OpenAPIOperation describes an operation of a path.
+type OpenAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+}
+
+// OpenAPIParameter describes a path or query parameter.
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+	Example     string         `json:"example,omitempty"`
+}
+
+// OpenAPIRequestBody describes the body of a request.
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse describes a response.
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIMediaType describes the content of a request or response.
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIComponents holds the schemas referenced by the operations.
+type OpenAPIComponents struct {
+	Schemas         map[string]*OpenAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]OpenAPISecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// OpenAPISecurityScheme describes how requests are authenticated.
+type OpenAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+// OpenAPISchema is the subset of the OpenAPI schema object the custom API types are described with.
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+	OneOf                []*OpenAPISchema          `json:"oneOf,omitempty"`
+}
+
+var (
+	apiSpecType    = reflect.TypeOf((*APISpec)(nil)).Elem()
+	reqContextType = reflect.TypeOf(&reqcontext.ReqContext{})
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+	pathParameter = regexp.MustCompile(`{([^}]+)}`)
+)
+
+// newOpenAPI generates the OpenAPI document of the given routes.
+// Request and response bodies are described by the parameters and results of the APISpec methods of the routes.
+func newOpenAPI(routes []route) (*OpenAPI, error) {
+	g := &openAPIGenerator{schemas: map[string]*OpenAPISchema{}}
+	doc := &OpenAPI{
+		OpenAPI: openAPIVersion,
+		Info: OpenAPIInfo{
+			Title:       "Swisscom service broker custom API",
+			Description: "Endpoints of the service broker not defined by the open service broker API spec.",
+			Version:     "1",
+		},
+		Paths: map[string]map[string]*OpenAPIOperation{},
+		Components: OpenAPIComponents{
+			Schemas: g.schemas,
+			SecuritySchemes: map[string]OpenAPISecurityScheme{
+				"basicAuth":  {Type: "http", Scheme: "basic"},
+				"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+		Security: []map[string][]string{{"basicAuth": {}}, {"bearerAuth": {}}},
+	}
+	errorSchema := g.schema(reflect.TypeOf(apiresponses.ErrorResponse{}))
+
+	for _, r := range routes {
+		op, err := g.operation(r)
+		if err != nil {
+			return nil, err
+		}
+		op.Responses["default"] = OpenAPIResponse{
+			Description: "Error",
+			Content:     map[string]OpenAPIMediaType{"application/json": {Schema: errorSchema}},
+		}
+		if doc.Paths[r.path] == nil {
+			doc.Paths[r.path] = map[string]*OpenAPIOperation{}
+		}
+		doc.Paths[r.path][strings.ToLower(r.method)] = op
+	}
+	return doc, nil
+}
+
+// newInstanceOpenAPI generates the OpenAPI document of the routes available for the service of an instance.
+// The instance ID is filled in as example and the description explains how to connect to the given endpoints.
+func newInstanceOpenAPI(instanceID string, service crossplane.ServiceName, endpoints []Endpoint) (*OpenAPI, error) {
+	doc, err := newOpenAPI(instanceRoutes(service))
+	if err != nil {
+		return nil, err
+	}
+	doc.Info.Title = fmt.Sprintf("%s %s", service, instanceID)
+	doc.Info.Description = instanceDescription(instanceID, service, endpoints)
+	for _, ops := range doc.Paths {
+		for _, op := range ops {
+			for i := range op.Parameters {
+				if op.Parameters[i].Name == "service_instance_id" {
+					op.Parameters[i].Example = instanceID
+				}
+			}
+		}
+	}
+	return doc, nil
+}
+
+// instanceDescription describes how to connect to an instance and how to use the service, formatted as markdown.
+func instanceDescription(instanceID string, service crossplane.ServiceName, endpoints []Endpoint) string {
+	b := &strings.Builder{}
+	b.WriteString("## Connection\n\n")
+	switch {
+	case len(endpoints) == 0:
+		b.WriteString("The connection details are available once the instance is ready.\n")
+	default:
+		for _, e := range endpoints {
+			describeEndpoint(b, e)
+		}
+	}
+	b.WriteString("\nThe credentials are part of the service binding.\n")
+	if len(endpoints) > 0 && endpoints[0].TLS != nil && endpoints[0].TLS.CAFingerprint != "" {
+		fmt.Fprintf(b, "The server certificate is signed by the CA certificate with the SHA-256 fingerprint `%s`, "+
+			"which is part of the endpoints.\n", endpoints[0].TLS.CAFingerprint)
+	}
+
+	switch service {
+	case crossplane.RedisService:
+		master := defaultSentinelMaster
+		for _, e := range endpoints {
+			if e.SentinelMaster != nil {
+				master = e.SentinelMaster.Name
+			}
+		}
+		fmt.Fprintf(b, "\n## Sentinel\n\n"+
+			"Redis runs with a replica which takes over if the master fails. "+
+			"Clients supporting Redis Sentinel should connect to the Sentinel endpoint and ask it for the address of the master `%s`, "+
+			"which keeps them connected after a failover. Other clients connect to the Redis endpoint directly.\n", master)
+	case crossplane.MariaDBService:
+		fmt.Fprintf(b, "\n## Databases and users\n\n"+
+			"Databases are created by provisioning instances of the `%s` service with the `parent_reference` parameter set to `%s`. "+
+			"Users of a database are created by binding the database instance, each binding gets its own user.\n",
+			crossplane.MariaDBDatabaseService, instanceID)
+	case crossplane.MariaDBDatabaseService:
+		b.WriteString("\n## Users\n\n" +
+			"The database is part of a Galera cluster, the endpoints are the ones of the cluster. " +
+			"Users of the database are created by binding this instance, each binding gets its own user.\n")
+	}
+	if service == crossplane.MariaDBService || service == crossplane.MariaDBDatabaseService {
+		b.WriteString("\nThe endpoints of the individual nodes and their role are listed with `nodes=true`, " +
+			"which allows sending reads to other nodes than the writer.\n")
+	}
+	return b.String()
+}
+
+// endpointTitles are the names of the endpoints as shown in the description.
+var endpointTitles = map[string]string{
+	EndpointNameRedis:    "Redis",
+	EndpointNameSentinel: "Sentinel",
+	EndpointNameMariaDB:  "MariaDB",
+}
+
+func describeEndpoint(b *strings.Builder, e Endpoint) {
+	title, ok := endpointTitles[e.Name]
+	if !ok {
+		title = e.Name
+	}
+	fmt.Fprintf(b, "- %s: `%s:%s`", title, e.Destination, e.Ports)
+	switch {
+	case e.TLS == nil:
+	case e.TLS.Required:
+		fmt.Fprintf(b, ", TLS required on port `%s`", e.TLS.Port)
+	default:
+		fmt.Fprintf(b, ", TLS on port `%s`", e.TLS.Port)
+	}
+	b.WriteString("\n")
+}
+
+// openAPIGenerator collects the schemas of the named types used by the operations.
+type openAPIGenerator struct {
+	schemas map[string]*OpenAPISchema
+}
+
+func (g *openAPIGenerator) operation(r route) (*OpenAPIOperation, error) {
+	op := &OpenAPIOperation{
+		OperationID: r.operations[0],
+		Summary:     r.summary,
+		Description: fmt.Sprintf("Requires the %s role.", r.role),
+		Responses:   map[string]OpenAPIResponse{},
+	}
+	for _, p := range pathParameter.FindAllStringSubmatch(r.path, -1) {
+		op.Parameters = append(op.Parameters, OpenAPIParameter{
+			Name:     p[1],
+			In:       "path",
+			Required: true,
+			Schema:   &OpenAPISchema{Type: "string"},
+		})
+	}
+	for _, q := range r.query {
+		op.Parameters = append(op.Parameters, OpenAPIParameter{
+			Name:        q.name,
+			In:          "query",
+			Description: q.description,
+			Schema:      q.schema,
+		})
+	}
+
+	var results []*OpenAPISchema
+	for _, name := range r.operations {
+		m, ok := apiSpecType.MethodByName(name)
+		if !ok {
+			return nil, fmt.Errorf("route %s %s: APISpec has no method %q", r.method, r.path, name)
+		}
+		if body := requestBodyType(m.Type); body != nil && op.RequestBody == nil {
+			op.RequestBody = &OpenAPIRequestBody{
+				Required: !r.optionalBody,
+				Content:  map[string]OpenAPIMediaType{"application/json": {Schema: g.schema(body)}},
+			}
+		}
+		if m.Type.NumOut() == 2 {
+			result := m.Type.Out(0)
+			if result.Kind() == reflect.Ptr {
+				result = result.Elem()
+			}
+			if !containsSchema(results, g.schema(result)) {
+				results = append(results, g.schema(result))
+			}
+		}
+	}
+
+	res := OpenAPIResponse{Description: http.StatusText(r.status)}
+	switch len(results) {
+	case 0:
+	case 1:
+		res.Content = map[string]OpenAPIMediaType{"application/json": {Schema: results[0]}}
+	default:
+		res.Content = map[string]OpenAPIMediaType{"application/json": {Schema: &OpenAPISchema{OneOf: results}}}
+	}
+	op.Responses[strconv.Itoa(r.status)] = res
+	return op, nil
+}
+
+func containsSchema(schemas []*OpenAPISchema, s *OpenAPISchema) bool {
+	for _, e := range schemas {
+		if reflect.DeepEqual(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestBodyType returns the type of the request body of an APISpec method, which is the only struct
+// passed by pointer besides the request context. Nil if the method takes no body.
+func requestBodyType(m reflect.Type) reflect.Type {
+	for i := 0; i < m.NumIn(); i++ {
+		t := m.In(i)
+		if t != reqContextType && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+			return t.Elem()
+		}
+	}
+	return nil
+}
+
+// schema returns the schema of the given type. Named structs are added to the components and referenced.
+func (g *openAPIGenerator) schema(t reflect.Type) *OpenAPISchema {
+	switch t {
+	case timeType:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &OpenAPISchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if s.Ref != "" {
+			// Siblings of $ref are ignored, which is why a nullable reference needs to be wrapped
+			return &OpenAPISchema{OneOf: []*OpenAPISchema{s}, Nullable: true}
+		}
+		s.Nullable = true
+		return s
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &OpenAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &OpenAPISchema{Type: "number"}
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &OpenAPISchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.structSchema(t)
+	default:
+		// interface{} and everything else can hold any value
+		return &OpenAPISchema{}
+	}
+}
+
+func (g *openAPIGenerator) structSchema(t reflect.Type) *OpenAPISchema {
+	ref := &OpenAPISchema{Ref: "#/components/schemas/" + t.Name()}
+	if t.Name() != "" {
+		if _, ok := g.schemas[t.Name()]; ok {
+			return ref
+		}
+	}
+
+	s := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+	if t.Name() != "" {
+		// Registered before the fields are described to support recursive types
+		g.schemas[t.Name()] = s
+	}
+	g.addFields(s, t)
+	if t.Name() == "" {
+		return s
+	}
+	return ref
+}
+
+// addFields adds the JSON encoded fields of the struct to the schema, fields of embedded structs are inlined.
+func (g *openAPIGenerator) addFields(s *OpenAPISchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(s, ft)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package custom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+)
+
+const (
+	// PrometheusInstanceLabel is the label identifying the instance metrics have been scraped from.
+	// For MariaDB databases this is the ID of the Galera cluster they are part of.
+	PrometheusInstanceLabel = "service_instance_id"
+
+	// prometheusTimeout limits the time a single range query may take.
+	prometheusTimeout = 30 * time.Second
+	// maxUsageSamples is the maximum number of samples per series Prometheus returns.
+	maxUsageSamples = 11000
+	// defaultUsageSamples is the number of samples per series returned if no step is given.
+	defaultUsageSamples = 250
+)
+
+// prometheusClient queries a Prometheus compatible HTTP API.
+type prometheusClient struct {
+	url    string
+	client *http.Client
+}
+
+func newPrometheusClient(u string) *prometheusClient {
+	return &prometheusClient{
+		url:    strings.TrimSuffix(u, "/"),
+		client: &http.Client{Timeout: prometheusTimeout},
+	}
+}
+
+// prometheusResponse is the envelope of every response of the Prometheus HTTP API.
+type prometheusResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string             `json:"resultType"`
+		Result     []prometheusSeries `json:"result"`
+	} `json:"data"`
+}
+
+// prometheusSeries is a single series of a matrix result.
+type prometheusSeries struct {
+	Metric map[string]string `json:"metric"`
+	// Values are pairs of a unix timestamp and the sample value formatted as string.
+	Values [][2]interface{} `json:"values"`
+}
+
+// queryRange evaluates the query over the given range.
+func (c prometheusClient) queryRange(ctx context.Context, query string, r UsageRange) ([]prometheusSeries, error) {
+	params := url.Values{
+		"query": {query},
+		"start": {formatPrometheusTime(r.From)},
+		"end":   {formatPrometheusTime(r.To)},
+		"step":  {strconv.FormatFloat(r.Step.Seconds(), 'f', -1, 64)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/api/v1/query_range", strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var pr prometheusResponse
+	if err := json.NewDecoder(res.Body).Decode(&pr); err != nil {
+		return nil, fmt.Errorf("unable to decode prometheus response (status %d): %w", res.StatusCode, err)
+	}
+	if pr.Status != "success" {
+		return nil, fmt.Errorf("prometheus query failed: %s: %s", pr.ErrorType, pr.Error)
+	}
+	if pr.Data.ResultType != "matrix" {
+		return nil, fmt.Errorf("unexpected prometheus result type %q", pr.Data.ResultType)
+	}
+	return pr.Data.Result, nil
+}
+
+func formatPrometheusTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', -1, 64)
+}
+
+// samples converts the values of a series. Samples which can't be represented in JSON are skipped.
+func (s prometheusSeries) samples() ([]UsageSample, error) {
+	samples := make([]UsageSample, 0, len(s.Values))
+	for _, v := range s.Values {
+		ts, ok := v[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected sample timestamp %v", v[0])
+		}
+		raw, ok := v[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected sample value %v", v[1])
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		sec, frac := math.Modf(ts)
+		samples = append(samples, UsageSample{
+			Time:  time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(),
+			Value: value,
+		})
+	}
+	return samples, nil
+}
+
+// usageQuery is a query returning one or more series of a usage metric.
+type usageQuery struct {
+	name  string
+	query string
+}
+
+// usageQueries returns the queries for the usage history of an instance.
+// The cluster is the instance actually exporting the metrics, which is the instance itself
+// for everything but MariaDB databases.
+func usageQueries(instance, cluster *crossplane.Instance) ([]usageQuery, error) {
+	sel := fmt.Sprintf("%s=%q", PrometheusInstanceLabel, cluster.ID())
+
+	switch instance.Labels.ServiceName {
+	case crossplane.RedisService:
+		return []usageQuery{
+			{name: "used_memory", query: fmt.Sprintf("max(redis_memory_used_bytes{%s})", sel)},
+			{name: "max_memory", query: fmt.Sprintf("max(redis_memory_max_bytes{%s})", sel)},
+			{name: "connected_clients", query: fmt.Sprintf("sum(redis_connected_clients{%s})", sel)},
+			{name: "keys", query: fmt.Sprintf("max(sum by (pod) (redis_db_keys{%s}))", sel)},
+			{name: "ops_per_sec", query: fmt.Sprintf("sum(rate(redis_commands_processed_total{%s}[5m]))", sel)},
+		}, nil
+	case crossplane.MariaDBService:
+		return []usageQuery{
+			{name: "database_size", query: fmt.Sprintf("max by (schema) (sum by (schema, pod) (mysql_info_schema_table_size{%s}))", sel)},
+			{name: "active_connections", query: fmt.Sprintf("sum(mysql_global_status_threads_connected{%s})", sel)},
+			{name: "max_connections", query: fmt.Sprintf("max(mysql_global_variables_max_connections{%s})", sel)},
+			{name: "cluster_size", query: fmt.Sprintf("min(mysql_global_status_wsrep_cluster_size{%s})", sel)},
+		}, nil
+	case crossplane.MariaDBDatabaseService:
+		sel += fmt.Sprintf(",schema=%q", instance.ID())
+		return []usageQuery{
+			{name: "database_size", query: fmt.Sprintf("max by (schema) (sum by (schema, pod) (mysql_info_schema_table_size{%s}))", sel)},
+		}, nil
+	default:
+		return nil, errNotImplemented
+	}
+}
+
+// queryUsageHistory runs the queries over the given range.
+func queryUsageHistory(ctx context.Context, c *prometheusClient, queries []usageQuery, r UsageRange) (*UsageHistory, error) {
+	h := &UsageHistory{
+		From:   r.From,
+		To:     r.To,
+		Step:   r.Step.String(),
+		Series: []UsageSeries{},
+	}
+	for _, q := range queries {
+		result, err := c.queryRange(ctx, q.query, r)
+		if err != nil {
+			return nil, fmt.Errorf("querying %s: %w", q.name, err)
+		}
+		for _, s := range result {
+			samples, err := s.samples()
+			if err != nil {
+				return nil, fmt.Errorf("querying %s: %w", q.name, err)
+			}
+			series := UsageSeries{
+				Name:    q.name,
+				Samples: samples,
+			}
+			if len(s.Metric) > 0 {
+				series.Labels = s.Metric
+			}
+			h.Series = append(h.Series, series)
+		}
+	}
+	return h, nil
+}
+
+// defaultUsageStep returns the step resulting in about defaultUsageSamples samples, rounded to full seconds.
+func defaultUsageStep(from, to time.Time) time.Duration {
+	step := (to.Sub(from) / defaultUsageSamples).Round(time.Second)
+	if step < time.Second {
+		return time.Second
+	}
+	return step
+}
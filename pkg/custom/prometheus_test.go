@@ -0,0 +1,126 @@
+package custom
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryUsageHistory(t *testing.T) {
+	from := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	r := UsageRange{From: from, To: from.Add(10 * time.Minute), Step: 5 * time.Minute}
+
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The handler runs in the goroutine of the server, where the test must not be stopped.
+		if !assert.Equal(t, "/api/v1/query_range", req.URL.Path) || !assert.NoError(t, req.ParseForm()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, "1614592800", req.Form.Get("start"))
+		assert.Equal(t, "1614593400", req.Form.Get("end"))
+		assert.Equal(t, "300", req.Form.Get("step"))
+		queries = append(queries, req.Form.Get("query"))
+
+		w.Header().Set("Content-Type", "application/json")
+		switch len(queries) {
+		case 1:
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"schema":"db1"},"values":[[1614592800,"1024"],[1614593100,"2048"],[1614593400,"NaN"]]},
+				{"metric":{"schema":"db2"},"values":[[1614592800.5,"1"]]}
+			]}}`)
+		default:
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{},"values":[[1614592800,"3"]]}
+			]}}`)
+		}
+	}))
+	defer srv.Close()
+
+	h, err := queryUsageHistory(context.Background(), newPrometheusClient(srv.URL+"/"), []usageQuery{
+		{name: "database_size", query: "size"},
+		{name: "cluster_size", query: "cluster"},
+	}, r)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"size", "cluster"}, queries)
+	assert.Equal(t, &UsageHistory{
+		From: r.From,
+		To:   r.To,
+		Step: "5m0s",
+		Series: []UsageSeries{
+			{
+				Name:   "database_size",
+				Labels: map[string]string{"schema": "db1"},
+				Samples: []UsageSample{
+					{Time: from, Value: 1024},
+					{Time: from.Add(5 * time.Minute), Value: 2048},
+				},
+			},
+			{
+				Name:    "database_size",
+				Labels:  map[string]string{"schema": "db2"},
+				Samples: []UsageSample{{Time: from.Add(500 * time.Millisecond), Value: 1}},
+			},
+			{
+				Name:    "cluster_size",
+				Samples: []UsageSample{{Time: from, Value: 3}},
+			},
+		},
+	}, h)
+}
+
+func TestQueryUsageHistory_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+	}))
+	defer srv.Close()
+
+	from := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	_, err := queryUsageHistory(context.Background(), newPrometheusClient(srv.URL), []usageQuery{
+		{name: "used_memory", query: "invalid("},
+	}, UsageRange{From: from, To: from.Add(time.Hour), Step: time.Minute})
+	assert.EqualError(t, err, "querying used_memory: prometheus query failed: bad_data: parse error")
+}
+
+func TestValidateUsageRange(t *testing.T) {
+	from := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		r       UsageRange
+		wantErr string
+	}{
+		"valid": {
+			r: UsageRange{From: from, To: from.Add(time.Hour), Step: time.Minute},
+		},
+		"to before from": {
+			r:       UsageRange{From: from, To: from.Add(-time.Hour), Step: time.Minute},
+			wantErr: "from must be before to",
+		},
+		"no step": {
+			r:       UsageRange{From: from, To: from.Add(time.Hour)},
+			wantErr: "step must be positive",
+		},
+		"too many samples": {
+			r:       UsageRange{From: from, To: from.Add(24 * time.Hour), Step: time.Second},
+			wantErr: "range results in more than 11000 samples, increase the step",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := validateUsageRange(tt.r)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
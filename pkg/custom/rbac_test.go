@@ -0,0 +1,64 @@
+package custom
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// TestRBAC checks the roles of the deployment grant the access the broker needs, which the fake client doesn't.
+func TestRBAC(t *testing.T) {
+	f, err := os.Open("../../deploy/base/rbac.yaml")
+	require.NoError(t, err)
+	defer f.Close()
+
+	granted := map[string]map[string]bool{}
+	d := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		var role struct {
+			Kind  string              `json:"kind"`
+			Rules []rbacv1.PolicyRule `json:"rules"`
+		}
+		err := d.Decode(&role)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		for _, r := range role.Rules {
+			for _, g := range r.APIGroups {
+				for _, res := range r.Resources {
+					if granted[g+"/"+res] == nil {
+						granted[g+"/"+res] = map[string]bool{}
+					}
+					for _, v := range r.Verbs {
+						granted[g+"/"+res][v] = true
+					}
+				}
+			}
+		}
+	}
+
+	required := map[string][]string{
+		// Operation jobs are created, listed and deleted, their results are patched onto them, see recordJobResult.
+		"batch/jobs": {"get", "list", "watch", "create", "patch", "delete"},
+		// The pods of operation jobs are watched by RecordJobResults.
+		"/pods": {"get", "list", "watch"},
+		// Backup schedules are managed by SetBackupSchedule and listed by the BackupPruner.
+		"batch/cronjobs": {"get", "list", "create", "update", "delete"},
+		// Revisions of service definitions are recorded, and removed again if applying them fails or there are too many.
+		"/configmaps": {"get", "list", "create", "delete"},
+		// Plans are created, updated and, on rollbacks, deleted.
+		"apiextensions.crossplane.io/compositions": {"get", "list", "create", "update", "delete"},
+	}
+	for resource, verbs := range required {
+		for _, v := range verbs {
+			assert.True(t, granted[resource][v], "%s must be granted on %s", v, resource)
+		}
+	}
+}
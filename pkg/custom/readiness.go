@@ -0,0 +1,95 @@
+package custom
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/pivotal-cf/brokerapi/v8/domain/apiresponses"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// instanceNotReadyRetryAfter is how long clients are asked to wait while an instance is being provisioned.
+	instanceNotReadyRetryAfter = 30 * time.Second
+	// instanceUnavailableRetryAfter is how long clients are asked to wait if a ready instance doesn't accept connections.
+	instanceUnavailableRetryAfter = 10 * time.Second
+	// probeTimeout limits the time probing a single endpoint may take.
+	probeTimeout = 2 * time.Second
+)
+
+// retryError is a failure response which asks the client to retry the request later.
+// The delay is returned in the Retry-After header.
+type retryError struct {
+	*apiresponses.FailureResponse
+	retryAfter time.Duration
+}
+
+func errInstanceNotReady(instanceID string) error {
+	return &retryError{
+		FailureResponse: apiresponses.NewFailureResponseBuilder(
+			fmt.Errorf("instance %q is not yet ready", instanceID),
+			http.StatusConflict,
+			"instance-not-ready").
+			WithErrorKey("InstanceNotReady").
+			Build(),
+		retryAfter: instanceNotReadyRetryAfter,
+	}
+}
+
+func errInstanceUnavailable(instanceID string, err error) error {
+	return &retryError{
+		FailureResponse: apiresponses.NewFailureResponseBuilder(
+			fmt.Errorf("instance %q doesn't accept connections: %w", instanceID, err),
+			http.StatusServiceUnavailable,
+			"instance-unavailable").
+			WithErrorKey("InstanceUnavailable").
+			Build(),
+		retryAfter: instanceUnavailableRetryAfter,
+	}
+}
+
+// checkReady returns errInstanceNotReady unless the composite of the instance has the Ready condition.
+func checkReady(instance *crossplane.Instance) error {
+	if instance.Composite.GetCondition(xrv1.TypeReady).Status != corev1.ConditionTrue {
+		return errInstanceNotReady(instance.ID())
+	}
+	return nil
+}
+
+// probeEndpoints connects to every endpoint and returns errInstanceUnavailable if one of them doesn't accept
+// the connection. Endpoints which require TLS are probed on their TLS port.
+func probeEndpoints(ctx context.Context, instanceID string, endpoints []Endpoint) error {
+	for _, e := range endpoints {
+		if err := probeEndpoint(ctx, e); err != nil {
+			return errInstanceUnavailable(instanceID, err)
+		}
+	}
+	return nil
+}
+
+func probeEndpoint(ctx context.Context, e Endpoint) error {
+	addr, tlsConfig, err := dialTarget(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// MariaDB negotiates TLS within its own protocol, which the probe doesn't speak.
+	if tlsConfig == nil || e.Name == EndpointNameMariaDB {
+		return nil
+	}
+	return tls.Client(conn, tlsConfig).HandshakeContext(ctx)
+}
@@ -0,0 +1,89 @@
+package custom
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	xrv1 "github.com/crossplane/crossplane-runtime/apis/common/v1"
+	"github.com/crossplane/crossplane-runtime/pkg/resource/unstructured/composite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+)
+
+func TestCheckReady(t *testing.T) {
+	xr := composite.New()
+	xr.SetName("1-1-1")
+	instance := &crossplane.Instance{Composite: xr}
+
+	xr.SetConditions(xrv1.Creating())
+	err := checkReady(instance)
+	require.IsType(t, &retryError{}, err)
+	assert.EqualError(t, err, `instance "1-1-1" is not yet ready`)
+	assert.Equal(t, http.StatusConflict, err.(*retryError).ValidatedStatusCode(nil))
+
+	xr.SetConditions(xrv1.Available())
+	assert.NoError(t, checkReady(instance))
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	endpoints := []Endpoint{{Destination: host, Ports: port, Protocol: "tcp"}}
+
+	assert.NoError(t, probeEndpoints(context.Background(), "1-1-1", endpoints))
+
+	require.NoError(t, l.Close())
+	err = probeEndpoints(context.Background(), "1-1-1", endpoints)
+	require.IsType(t, &retryError{}, err)
+	assert.Equal(t, http.StatusServiceUnavailable, err.(*retryError).ValidatedStatusCode(nil))
+}
+
+func TestProbeEndpoints_TLS(t *testing.T) {
+	serverConfig, ca := newTestServerTLSConfig(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	endpoints := []Endpoint{{Name: EndpointNameRedis, Destination: host, Ports: "1", Protocol: "tcp",
+		TLS: &EndpointTLS{Required: true, Port: port, CACertificate: string(ca)}}}
+	assert.NoError(t, probeEndpoints(context.Background(), "1-1-1", endpoints), "endpoints requiring TLS must be probed on their TLS port")
+
+	otherCA, _ := newTestCACertificate(t)
+	endpoints[0].TLS.CACertificate = string(otherCA)
+	err = probeEndpoints(context.Background(), "1-1-1", endpoints)
+	require.IsType(t, &retryError{}, err)
+	assert.ErrorContains(t, err, "certificate signed by unknown authority")
+}
+
+func TestAPI_HandleRetryError(t *testing.T) {
+	logger := lager.NewLogger("test")
+	a := API{logger: logger}
+	w := httptest.NewRecorder()
+
+	a.handleAPIError(reqcontext.NewReqContext(context.Background(), logger, nil), w, errInstanceNotReady("1-1-1"))
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error":"InstanceNotReady","description":"instance \"1-1-1\" is not yet ready"}`, w.Body.String())
+}
@@ -0,0 +1,324 @@
+package custom
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// redisTimeout limits the time a single conversation with a Redis instance may take.
+const redisTimeout = 5 * time.Second
+
+const (
+	// SentinelMasterKey is the connection detail holding the name of the master group monitored by Sentinel.
+	SentinelMasterKey = "sentinelMaster"
+	// defaultSentinelMaster is the name of the master group if the connection details don't name it.
+	defaultSentinelMaster = "mymaster"
+)
+
+// redisConn is a minimal client of the Redis serialization protocol, sufficient for the
+// few commands the broker sends to instances.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply of the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// dialRedis connects to a Redis server and authenticates if a password is given.
+// The connection uses TLS if a TLS configuration is given.
+func dialRedis(ctx context.Context, addr, password string, tlsConfig *tls.Config) (*redisConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := c.Do("AUTH", password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("unable to authenticate: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its reply, which is either a string, an int64, nil or a slice of replies.
+func (c *redisConn) Do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	default:
+		return nil, fmt.Errorf("unknown reply type %q", line[0])
+	}
+}
+
+// querySentinelMaster asks Sentinel for the address of the current master of the group.
+func querySentinelMaster(ctx context.Context, addr, password, group string, tlsConfig *tls.Config) (string, string, error) {
+	c, err := dialRedis(ctx, addr, password, tlsConfig)
+	if err != nil {
+		return "", "", err
+	}
+	defer c.Close()
+
+	reply, err := c.Do("SENTINEL", "get-master-addr-by-name", group)
+	if err != nil {
+		return "", "", err
+	}
+	return parseSentinelMasterAddr(reply, group)
+}
+
+const (
+	// sentinelMasterRefresh is the age after which the master of a group is asked for again.
+	sentinelMasterRefresh = 30 * time.Second
+	// sentinelMasterExpiry is the age after which masters which haven't been asked for are forgotten.
+	sentinelMasterExpiry = 10 * time.Minute
+)
+
+// sentinelMasterCache resolves the masters of Sentinel groups in the background, so that listing the endpoints of
+// an instance never waits for Sentinel. Requests get the last known master, which is refreshed once it is
+// older than sentinelMasterRefresh.
+type sentinelMasterCache struct {
+	query func(ctx context.Context, addr, password, group string, tlsConfig *tls.Config) (string, string, error)
+	now   func() time.Time
+	log   lager.Logger
+
+	mu      sync.Mutex
+	masters map[string]*sentinelMasterEntry
+}
+
+// sentinelMasterEntry is the last result of asking Sentinel for the master of a group.
+type sentinelMasterEntry struct {
+	host, port string
+	err        error
+	resolvedAt time.Time
+	usedAt     time.Time
+	resolving  bool
+}
+
+func newSentinelMasterCache(log lager.Logger) *sentinelMasterCache {
+	return &sentinelMasterCache{query: querySentinelMaster, now: time.Now, log: log, masters: map[string]*sentinelMasterEntry{}}
+}
+
+// master fills in the last known master of the group monitored by the Sentinel at the address and
+// starts resolving it again if it is unknown or outdated.
+func (c *sentinelMasterCache) master(addr, password string, tlsConfig *tls.Config, m *SentinelMaster) {
+	key := addr + "/" + m.Name
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.masters {
+		if now.Sub(e.usedAt) > sentinelMasterExpiry && !e.resolving {
+			delete(c.masters, k)
+		}
+	}
+
+	e, ok := c.masters[key]
+	if !ok {
+		e = &sentinelMasterEntry{}
+		c.masters[key] = e
+	}
+	e.usedAt = now
+	if !e.resolving && (e.resolvedAt.IsZero() || now.Sub(e.resolvedAt) > sentinelMasterRefresh) {
+		e.resolving = true
+		go c.resolve(e, addr, password, m.Name, tlsConfig)
+	}
+
+	switch {
+	case e.resolvedAt.IsZero():
+		m.Status = SentinelMasterPending
+	case e.err != nil:
+		m.Status = SentinelMasterUnavailable
+	default:
+		m.Status = SentinelMasterResolved
+		m.Destination, m.Port = e.host, e.port
+	}
+}
+
+func (c *sentinelMasterCache) resolve(e *sentinelMasterEntry, addr, password, group string, tlsConfig *tls.Config) {
+	host, port, err := c.query(context.Background(), addr, password, group, tlsConfig)
+	if err != nil {
+		c.log.Info("sentinel-master-unavailable", lager.Data{"sentinel": addr, "master": group, "error": err.Error()})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.host, e.port, e.err = host, port, err
+	e.resolvedAt = c.now()
+	e.resolving = false
+}
+
+// parseSentinelMasterAddr parses the reply of SENTINEL get-master-addr-by-name, which is the host and port of the master.
+func parseSentinelMasterAddr(reply interface{}, group string) (string, string, error) {
+	if reply == nil {
+		return "", "", fmt.Errorf("sentinel doesn't monitor master %q", group)
+	}
+	addr, ok := reply.([]interface{})
+	if !ok || len(addr) != 2 {
+		return "", "", fmt.Errorf("unexpected reply %v", reply)
+	}
+	host, hostOK := addr[0].(string)
+	port, portOK := addr[1].(string)
+	if !hostOK || !portOK {
+		return "", "", fmt.Errorf("unexpected reply %v", reply)
+	}
+	return host, port, nil
+}
+
+// parseRedisInfo parses the reply of the INFO command into its fields.
+func parseRedisInfo(info string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// redisUsageFromInfo returns the usage described by the fields of the INFO reply.
+func redisUsageFromInfo(info map[string]string) (*RedisUsage, error) {
+	u := &RedisUsage{}
+	var err error
+	intField := func(name string) int64 {
+		if err != nil {
+			return 0
+		}
+		var v int64
+		v, err = strconv.ParseInt(info[name], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("unable to parse %s: %w", name, err)
+		}
+		return v
+	}
+
+	u.UsedMemory = intField("used_memory")
+	u.MaxMemory = intField("maxmemory")
+	u.ConnectedClients = intField("connected_clients")
+	u.OpsPerSec = intField("instantaneous_ops_per_sec")
+	lastSave := intField("rdb_last_save_time")
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyspace fields look like "db0:keys=1,expires=0,avg_ttl=0".
+	for k, v := range info {
+		if !strings.HasPrefix(k, "db") {
+			continue
+		}
+		for _, kv := range strings.Split(v, ",") {
+			if n, ok := strings.CutPrefix(kv, "keys="); ok {
+				keys, err := strconv.ParseInt(n, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("unable to parse keyspace of %s: %w", k, err)
+				}
+				u.Keys += keys
+			}
+		}
+	}
+
+	u.Persistence = RedisPersistence{
+		RDBLastSaveTime:   time.Unix(lastSave, 0).UTC(),
+		RDBLastSaveStatus: info["rdb_last_bgsave_status"],
+		AOFEnabled:        info["aof_enabled"] == "1",
+	}
+	if u.Persistence.AOFEnabled {
+		u.Persistence.AOFLastWriteStatus = info["aof_last_write_status"]
+	}
+	return u, nil
+}
@@ -0,0 +1,208 @@
+package custom
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRedisInfo = "# Server\r\n" +
+	"redis_version:6.0.10\r\n" +
+	"\r\n" +
+	"# Clients\r\n" +
+	"connected_clients:3\r\n" +
+	"\r\n" +
+	"# Memory\r\n" +
+	"used_memory:1048576\r\n" +
+	"maxmemory:268435456\r\n" +
+	"\r\n" +
+	"# Persistence\r\n" +
+	"rdb_last_save_time:1614592800\r\n" +
+	"rdb_last_bgsave_status:ok\r\n" +
+	"aof_enabled:0\r\n" +
+	"\r\n" +
+	"# Stats\r\n" +
+	"instantaneous_ops_per_sec:12\r\n" +
+	"\r\n" +
+	"# Keyspace\r\n" +
+	"db0:keys=10,expires=1,avg_ttl=0\r\n" +
+	"db1:keys=5,expires=0,avg_ttl=0\r\n"
+
+func TestRedisUsageFromInfo(t *testing.T) {
+	got, err := redisUsageFromInfo(parseRedisInfo(testRedisInfo))
+	require.NoError(t, err)
+	assert.Equal(t, &RedisUsage{
+		UsedMemory:       1048576,
+		MaxMemory:        268435456,
+		ConnectedClients: 3,
+		Keys:             15,
+		OpsPerSec:        12,
+		Persistence: RedisPersistence{
+			RDBLastSaveTime:   time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC),
+			RDBLastSaveStatus: "ok",
+		},
+	}, got)
+
+	_, err = redisUsageFromInfo(parseRedisInfo("used_memory:a lot\r\n"))
+	assert.EqualError(t, err, `unable to parse used_memory: strconv.ParseInt: parsing "a lot": invalid syntax`)
+}
+
+// serveTestRedis accepts a single connection on the listener and expects AUTH followed by INFO.
+func serveTestRedis(l net.Listener) {
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		readCommand := func() []string {
+			var args []string
+			header, _ := r.ReadString('\n')
+			if header == "" {
+				return nil
+			}
+			n := 0
+			for _, c := range strings.TrimSpace(header[1:]) {
+				n = n*10 + int(c-'0')
+			}
+			for i := 0; i < n; i++ {
+				_, _ = r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args = append(args, strings.TrimSpace(arg))
+			}
+			return args
+		}
+
+		if args := readCommand(); len(args) != 2 || args[1] != "secret" {
+			_, _ = conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+			return
+		}
+		_, _ = conn.Write([]byte("+OK\r\n"))
+		readCommand()
+		_, _ = conn.Write([]byte("$21\r\nconnected_clients:3\r\n\r\n"))
+	}()
+}
+
+func TestRedisConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	serveTestRedis(l)
+
+	c, err := dialRedis(context.Background(), l.Addr().String(), "secret", nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	reply, err := c.Do("INFO")
+	require.NoError(t, err)
+	assert.Equal(t, "connected_clients:3\r\n", reply)
+}
+
+func TestRedisConn_TLS(t *testing.T) {
+	serverConfig, ca := newTestServerTLSConfig(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	serveTestRedis(l)
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	addr, tlsConfig, err := dialTarget(Endpoint{
+		Destination: host,
+		Ports:       "6379",
+		TLS:         &EndpointTLS{Required: true, Port: port, CACertificate: string(ca)},
+	})
+	require.NoError(t, err)
+	c, err := dialRedis(context.Background(), addr, "secret", tlsConfig)
+	require.NoError(t, err)
+	defer c.Close()
+
+	reply, err := c.Do("INFO")
+	require.NoError(t, err)
+	assert.Equal(t, "connected_clients:3\r\n", reply)
+
+	otherCA, _ := newTestCACertificate(t)
+	_, tlsConfig, err = dialTarget(Endpoint{
+		Destination: host,
+		TLS:         &EndpointTLS{Required: true, Port: port, CACertificate: string(otherCA)},
+	})
+	require.NoError(t, err)
+	serveTestRedis(l)
+	_, err = dialRedis(context.Background(), addr, "secret", tlsConfig)
+	assert.ErrorContains(t, err, "certificate signed by unknown authority")
+}
+
+func TestParseSentinelMasterAddr(t *testing.T) {
+	host, port, err := parseSentinelMasterAddr([]interface{}{"10.0.0.1", "6379"}, "mymaster")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", host)
+	assert.Equal(t, "6379", port)
+
+	_, _, err = parseSentinelMasterAddr(nil, "mymaster")
+	assert.EqualError(t, err, `sentinel doesn't monitor master "mymaster"`)
+	_, _, err = parseSentinelMasterAddr("OK", "mymaster")
+	assert.EqualError(t, err, "unexpected reply OK")
+}
+
+func TestSentinelMasterCache(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	queried := make(chan string, 10)
+	var fail bool
+	var mu sync.Mutex
+	c := newSentinelMasterCache(lager.NewLogger("test"))
+	c.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	c.query = func(_ context.Context, addr, _, group string, _ *tls.Config) (string, string, error) {
+		defer func() { queried <- addr + "/" + group }()
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			return "", "", errors.New("connection refused")
+		}
+		return "10.0.0.1", "6379", nil
+	}
+	advance := func(d time.Duration, failing bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+		fail = failing
+	}
+	master := func() SentinelMaster {
+		m := SentinelMaster{Name: "mymaster"}
+		c.master("redis:26379", "secret", nil, &m)
+		return m
+	}
+
+	assert.Equal(t, SentinelMaster{Name: "mymaster", Status: SentinelMasterPending}, master(), "the first request must not wait for Sentinel")
+	assert.Equal(t, "redis:26379/mymaster", <-queried)
+	assert.Eventually(t, func() bool { return master().Status == SentinelMasterResolved }, time.Second, time.Millisecond)
+	assert.Equal(t, SentinelMaster{Name: "mymaster", Status: SentinelMasterResolved, Destination: "10.0.0.1", Port: "6379"}, master())
+	assert.Empty(t, queried, "masters must not be queried again before they are outdated")
+
+	advance(sentinelMasterRefresh+time.Second, true)
+	assert.Equal(t, SentinelMasterResolved, master().Status, "outdated masters are returned while they get refreshed")
+	<-queried
+	assert.Eventually(t, func() bool { return master().Status == SentinelMasterUnavailable }, time.Second, time.Millisecond)
+	assert.Empty(t, master().Destination)
+
+	advance(sentinelMasterExpiry+time.Second, false)
+	c.master("other:26379", "secret", nil, &SentinelMaster{Name: "mymaster"})
+	<-queried
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.NotContains(t, c.masters, "redis:26379/mymaster", "unused masters must be forgotten")
+}
@@ -0,0 +1,148 @@
+package custom
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// BackupPruneInterval is the interval the BackupPruner looks for expired backups in.
+const BackupPruneInterval = 10 * time.Minute
+
+// BackupPruner removes backups whose retention has passed, both their stored data and their jobs.
+type BackupPruner struct {
+	client client.Client
+	log    lager.Logger
+}
+
+// NewBackupPruner returns a pruner removing expired backups.
+func NewBackupPruner(cl client.Client, log lager.Logger) *BackupPruner {
+	return &BackupPruner{client: cl, log: log}
+}
+
+// Run prunes expired backups in the given interval until the context is done.
+func (p *BackupPruner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Prune(ctx, time.Now()); err != nil {
+			p.log.Error("prune-backups", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune removes the backups which have expired at the given time and the scheduled backups
+// no longer covered by the retention policy of their schedule.
+// Backups used by a running restore are kept until the restore has finished.
+func (p *BackupPruner) Prune(ctx context.Context, now time.Time) error {
+	jobs := &batchv1.JobList{}
+	if err := p.client.List(ctx, jobs, client.MatchingLabels{OperationLabel: operationBackup}); err != nil {
+		return err
+	}
+	inUse, err := backupsInUse(ctx, p.client)
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		b := backupFromJob(job, nil)
+		if b.ExpiresAt == nil || now.Before(*b.ExpiresAt) || inUse[job.Name] {
+			continue
+		}
+		p.prune(ctx, job, "backup-expired")
+	}
+
+	schedules := &batchv1.CronJobList{}
+	if err := p.client.List(ctx, schedules, client.MatchingLabels{OperationLabel: operationBackup}); err != nil {
+		return err
+	}
+	for i := range schedules.Items {
+		if err := p.pruneScheduled(ctx, &schedules.Items[i], inUse); err != nil {
+			p.log.Error("prune-scheduled-backups", err, lager.Data{"schedule": schedules.Items[i].Name})
+		}
+	}
+	return nil
+}
+
+// pruneScheduled removes the successful backups of the schedule its retention policy doesn't keep.
+func (p *BackupPruner) pruneScheduled(ctx context.Context, schedule *batchv1.CronJob, inUse map[string]bool) error {
+	a, ok := schedule.Annotations[RetentionPolicyAnnotation]
+	if !ok {
+		return nil
+	}
+	policy := RetentionPolicy{}
+	if err := json.Unmarshal([]byte(a), &policy); err != nil {
+		return err
+	}
+
+	jobs := &batchv1.JobList{}
+	err := p.client.List(ctx, jobs, client.InNamespace(schedule.Namespace), client.MatchingLabels{
+		OperationLabel:             operationBackup,
+		BackupTypeLabel:            string(BackupScheduled),
+		crossplane.InstanceIDLabel: schedule.Labels[crossplane.InstanceIDLabel],
+	})
+	if err != nil {
+		return err
+	}
+
+	kept := keptBackups(jobs.Items, policy)
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if kept[job.Name] || inUse[job.Name] || jobStatus(job) != OperationSucceeded {
+			continue
+		}
+		p.prune(ctx, job, "backup-retention-exceeded")
+	}
+	return nil
+}
+
+// prune removes the backup job and its stored data, logging the outcome with the given action.
+func (p *BackupPruner) prune(ctx context.Context, job *batchv1.Job, action string) {
+	var snapshot string
+	if r := recordedJobResult(job); r != nil {
+		snapshot = r.Snapshot
+	}
+	if err := pruneBackup(ctx, p.client, job, snapshot); err != nil {
+		p.log.Error("prune-backup", err, lager.Data{"backup-id": job.Name})
+		return
+	}
+	p.log.Info(action, lager.Data{"backup-id": job.Name, "instance-id": job.Labels[crossplane.InstanceIDLabel]})
+}
+
+// backupsInUse returns the IDs of the backups used by restores which haven't finished yet.
+func backupsInUse(ctx context.Context, cl client.Client) (map[string]bool, error) {
+	restores := &batchv1.JobList{}
+	if err := cl.List(ctx, restores, client.MatchingLabels{OperationLabel: operationRestore}); err != nil {
+		return nil, err
+	}
+	inUse := map[string]bool{}
+	for i := range restores.Items {
+		if s := jobStatus(&restores.Items[i]); s == OperationPending || s == OperationRunning {
+			inUse[restores.Items[i].Labels[BackupIDLabel]] = true
+		}
+	}
+	return inUse, nil
+}
+
+// pruneBackup starts the job removing the stored data of the backup and deletes the backup job.
+// The snapshot may be empty if the backup job has no result, see newPruneJob.
+func pruneBackup(ctx context.Context, cl client.Client, job *batchv1.Job, snapshot string) error {
+	if err := cl.Create(ctx, newPruneJob(job, snapshot)); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	err := cl.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	return client.IgnoreNotFound(err)
+}
@@ -0,0 +1,107 @@
+package custom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newFinishedBackupJob returns a succeeded backup job of instance 1-1-1 with the given annotations.
+func newFinishedBackupJob(name string, finished time.Time, annotations map[string]string) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "crossplane",
+			Name:        name,
+			Labels:      map[string]string{crossplane.InstanceIDLabel: "1-1-1", OperationLabel: operationBackup},
+			Annotations: annotations,
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: operationBackup, Args: []string{operationBackup}}}},
+			},
+		},
+		Status: batchv1.JobStatus{
+			CompletionTime: &metav1.Time{Time: finished},
+			Conditions:     []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func TestBackupPruner_Prune(t *testing.T) {
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+	expired := newFinishedBackupJob("backup-1", now.Add(-2*time.Hour), map[string]string{
+		RetentionAnnotation: "1h",
+		ResultAnnotation:    `{"snapshot":"abcd"}`,
+	})
+	current := newFinishedBackupJob("backup-2", now.Add(-30*time.Minute), map[string]string{RetentionAnnotation: "1h"})
+	unlimited := newFinishedBackupJob("backup-3", now.Add(-48*time.Hour), nil)
+	restored := newFinishedBackupJob("backup-4", now.Add(-2*time.Hour), map[string]string{RetentionAnnotation: "1h"})
+	restore := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "crossplane",
+		Name:      "restore-1-1-1",
+		Labels:    map[string]string{OperationLabel: operationRestore, BackupIDLabel: "backup-4"},
+	}}
+	cl := fake.NewClientBuilder().WithObjects(expired, current, unlimited, restored, restore).Build()
+
+	require.NoError(t, NewBackupPruner(cl, lager.NewLogger("test")).Prune(context.TODO(), now))
+
+	err := cl.Get(context.TODO(), client.ObjectKeyFromObject(expired), &batchv1.Job{})
+	assert.True(t, apierrors.IsNotFound(err), "expired backups must be removed")
+	prune := &batchv1.Job{}
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: "prune-backup-1"}, prune))
+	assert.Equal(t, []string{operationPrune}, prune.Spec.Template.Spec.Containers[0].Args)
+	assert.Contains(t, prune.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "SNAPSHOT", Value: "abcd"})
+	assert.Contains(t, prune.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "BACKUP_ID", Value: "backup-1"})
+
+	for _, job := range []*batchv1.Job{current, unlimited, restored} {
+		assert.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(job), &batchv1.Job{}), "backup %s must be kept", job.Name)
+	}
+}
+
+func TestBackupPruner_PruneScheduled(t *testing.T) {
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+	objs := []client.Object{&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "crossplane",
+		Name:        scheduleName("1-1-1"),
+		Labels:      map[string]string{crossplane.InstanceIDLabel: "1-1-1", OperationLabel: operationBackup},
+		Annotations: map[string]string{RetentionPolicyAnnotation: `{"keep_daily":2}`},
+	}}}
+	jobs := newScheduledBackupJobs(now, 4)
+	for i := range jobs {
+		objs = append(objs, &jobs[i])
+	}
+	restore := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "crossplane",
+		Name:      "restore-1-1-1",
+		Labels:    map[string]string{OperationLabel: operationRestore, BackupIDLabel: "schedule-1-1-1-20210307"},
+	}}
+	cl := fake.NewClientBuilder().WithObjects(append(objs, restore)...).Build()
+
+	require.NoError(t, NewBackupPruner(cl, lager.NewLogger("test")).Prune(context.TODO(), now))
+
+	for name, want := range map[string]bool{
+		"schedule-1-1-1-20210310": true,
+		"schedule-1-1-1-20210309": true,
+		"schedule-1-1-1-20210308": false,
+		"schedule-1-1-1-20210307": true,
+	} {
+		err := cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: name}, &batchv1.Job{})
+		if want {
+			assert.NoError(t, err, "backup %s must be kept", name)
+			continue
+		}
+		assert.True(t, apierrors.IsNotFound(err), "backup %s must be removed", name)
+		assert.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Namespace: "crossplane", Name: "prune-" + name}, &batchv1.Job{}))
+	}
+}
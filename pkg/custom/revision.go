@@ -0,0 +1,148 @@
+package custom
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"gomodules.xyz/jsonpatch/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RevisionLabel marks config maps holding a revision of a service definition with the revision number.
+	RevisionLabel = crossplane.SynToolsBase + "/revision"
+	// RevisionAuthorAnnotation holds the originating identity of the request which changed the definition.
+	RevisionAuthorAnnotation = crossplane.SynToolsBase + "/author"
+	// RollbackOfAnnotation holds the revision a rollback has applied.
+	RollbackOfAnnotation = crossplane.SynToolsBase + "/rollback-of"
+
+	revisionDefinitionKey = "definition"
+	revisionDiffKey       = "diff"
+
+	// maxRevisionAttempts limits the retries if another broker records a revision at the same time.
+	maxRevisionAttempts = 5
+	// maxRevisions is the number of revisions kept per service, older ones are removed.
+	maxRevisions = 50
+)
+
+// revisionName returns the name of the config map holding a revision.
+// Service IDs are hashed as they aren't necessarily valid object names.
+func revisionName(serviceID string, revision int) string {
+	hash := sha256.Sum256([]byte(serviceID))
+	return fmt.Sprintf("service-definition-%x-%d", hash[:8], revision)
+}
+
+// newRevisionConfigMap returns the config map recording the definition as the given revision.
+// The previous definition is nil for the first revision.
+func newRevisionConfigMap(namespace string, revision int, sd, previous *ServiceDefinitionRequest, author *OriginatingIdentity, rollbackOf *int) (*corev1.ConfigMap, error) {
+	definition, err := json.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := definitionDiff(previous, sd)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      revisionName(sd.ID, revision),
+			Namespace: namespace,
+			Labels: map[string]string{
+				crossplane.ServiceIDLabel: sd.ID,
+				RevisionLabel:             strconv.Itoa(revision),
+			},
+			Annotations: map[string]string{},
+		},
+		Data: map[string]string{
+			revisionDefinitionKey: string(definition),
+			revisionDiffKey:       string(diff),
+		},
+	}
+	if author != nil {
+		a, err := json.Marshal(author)
+		if err != nil {
+			return nil, err
+		}
+		cm.Annotations[RevisionAuthorAnnotation] = string(a)
+	}
+	if rollbackOf != nil {
+		cm.Annotations[RollbackOfAnnotation] = strconv.Itoa(*rollbackOf)
+	}
+	return cm, nil
+}
+
+// revisionFromConfigMap returns the revision recorded in the config map.
+func revisionFromConfigMap(cm *corev1.ConfigMap) (*ServiceDefinitionRevision, error) {
+	revision, err := strconv.Atoi(cm.Labels[RevisionLabel])
+	if err != nil {
+		return nil, fmt.Errorf("invalid revision of %q: %w", cm.Name, err)
+	}
+	r := &ServiceDefinitionRevision{
+		ServiceID:  cm.Labels[crossplane.ServiceIDLabel],
+		Revision:   revision,
+		CreatedAt:  cm.CreationTimestamp.Time,
+		Diff:       json.RawMessage(cm.Data[revisionDiffKey]),
+		Definition: &ServiceDefinitionRequest{},
+	}
+	if err := json.Unmarshal([]byte(cm.Data[revisionDefinitionKey]), r.Definition); err != nil {
+		return nil, fmt.Errorf("invalid definition of %q: %w", cm.Name, err)
+	}
+	if a, ok := cm.Annotations[RevisionAuthorAnnotation]; ok {
+		r.Author = &OriginatingIdentity{}
+		if err := json.Unmarshal([]byte(a), r.Author); err != nil {
+			return nil, fmt.Errorf("invalid author of %q: %w", cm.Name, err)
+		}
+	}
+	if rb, ok := cm.Annotations[RollbackOfAnnotation]; ok {
+		rollbackOf, err := strconv.Atoi(rb)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollback of %q: %w", cm.Name, err)
+		}
+		r.RollbackOf = &rollbackOf
+	}
+	return r, nil
+}
+
+// revisionsFromConfigMaps returns the revisions recorded in the config maps, oldest first.
+func revisionsFromConfigMaps(cms []corev1.ConfigMap) ([]ServiceDefinitionRevision, error) {
+	revisions := make([]ServiceDefinitionRevision, 0, len(cms))
+	for i := range cms {
+		r, err := revisionFromConfigMap(&cms[i])
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, *r)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+// definitionDiff returns the JSON patch turning the previous definition into the current one.
+// The patch adds the whole definition if there is no previous definition.
+func definitionDiff(previous, current *ServiceDefinitionRequest) (json.RawMessage, error) {
+	from := []byte("{}")
+	if previous != nil {
+		var err error
+		from, err = json.Marshal(previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+	to, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := jsonpatch.CreatePatch(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ops)
+}
@@ -0,0 +1,222 @@
+package custom
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi/v8/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestDefinitionDiff(t *testing.T) {
+	previous := &ServiceDefinitionRequest{ID: "1", Name: "redis-k8s", Description: "Redis"}
+	current := &ServiceDefinitionRequest{ID: "1", Name: "redis-k8s", Description: "Redis 6"}
+
+	diff, err := definitionDiff(previous, current)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"op":"replace","path":"/description","value":"Redis 6"}]`, string(diff))
+
+	diff, err = definitionDiff(current, current)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[]`, string(diff))
+}
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	identity, err := parseOriginatingIdentity("cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}`)))
+	require.NoError(t, err)
+	assert.Equal(t, &OriginatingIdentity{
+		Platform: "cloudfoundry",
+		Value:    map[string]interface{}{"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"},
+	}, identity)
+
+	_, err = parseOriginatingIdentity("cloudfoundry")
+	assert.EqualError(t, err, "originating identity must consist of platform and value")
+}
+
+func TestAPIHandler_ServiceDefinitionRevisions(t *testing.T) {
+	xrd := newCompositeResourceDefinition("xredis.syn.tools")
+	xrd.Object["spec"] = map[string]interface{}{"names": map[string]interface{}{"kind": "CompositeRedisInstance"}}
+	template := newComposition("redis-template")
+	template.Object["spec"] = map[string]interface{}{
+		"compositeTypeRef": map[string]interface{}{"apiVersion": "syn.tools/v1alpha1", "kind": "CompositeRedisInstance"},
+	}
+	cl := fake.NewClientBuilder().WithObjects([]client.Object{xrd, template}...).Build()
+
+	logger := lager.NewLogger("test")
+	h := NewAPIHandler(nil, cl, nil, &Config{Namespace: "broker"}, logger)
+	ctx := context.WithValue(context.TODO(), middlewares.OriginatingIdentityKey,
+		"kubernetes "+base64.StdEncoding.EncodeToString([]byte(`{"username":"admin"}`)))
+	rctx := reqcontext.NewReqContext(ctx, logger, nil)
+
+	serviceID := "d9b8ab3e-2f4a-4d51-8b7e-8a1f1c0b0d01"
+	sd := &ServiceDefinitionRequest{
+		ID:                          serviceID,
+		Name:                        "redis-k8s",
+		Description:                 "Redis",
+		CompositeResourceDefinition: "xredis.syn.tools",
+		Plans: []PlanDefinition{
+			{ID: "d9b8ab3e-2f4a-4d51-8b7e-8a1f1c0b0d02", Name: "small", Description: "Small Redis", CompositionRef: "redis-template"},
+		},
+	}
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, true))
+	revisions, err := h.ServiceDefinitionRevisions(rctx, serviceID)
+	require.NoError(t, err)
+	assert.Empty(t, revisions, "dry runs must not change anything")
+	require.NoError(t, cl.Get(ctx, client.ObjectKeyFromObject(xrd), xrd))
+	assert.Empty(t, xrd.GetLabels())
+
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false), "unchanged definitions must not be recorded")
+	sd.Description = "Redis 6"
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+
+	revisions, err = h.ServiceDefinitionRevisions(rctx, serviceID)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	assert.Equal(t, 1, revisions[0].Revision)
+	assert.Equal(t, "Redis", revisions[0].Definition.Description)
+	assert.Equal(t, &OriginatingIdentity{Platform: "kubernetes", Value: map[string]interface{}{"username": "admin"}}, revisions[0].Author)
+	assert.Equal(t, 2, revisions[1].Revision)
+	assert.JSONEq(t, `[{"op":"replace","path":"/description","value":"Redis 6"}]`, string(revisions[1].Diff))
+
+	r, err := h.RollbackServiceDefinition(rctx, serviceID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, r.Revision)
+	assert.Equal(t, 1, *r.RollbackOf)
+	assert.JSONEq(t, `[{"op":"replace","path":"/description","value":"Redis"}]`, string(r.Diff))
+
+	require.NoError(t, cl.Get(ctx, client.ObjectKeyFromObject(xrd), xrd))
+	assert.Equal(t, "Redis", xrd.GetAnnotations()[crossplane.DescriptionAnnotation])
+
+	_, err = h.RollbackServiceDefinition(rctx, serviceID, 4)
+	assert.Equal(t, errRevisionDoesNotExist, err)
+}
+
+// newTestDefinitionHandler returns a handler with the definition and template of a Redis service
+// and a service definition with two plans using them.
+func newTestDefinitionHandler(funcs interceptor.Funcs) (*APIHandler, client.Client, *ServiceDefinitionRequest) {
+	xrd := newCompositeResourceDefinition("xredis.syn.tools")
+	xrd.Object["spec"] = map[string]interface{}{
+		"group":    "syn.tools",
+		"names":    map[string]interface{}{"kind": "CompositeRedisInstance"},
+		"versions": []interface{}{map[string]interface{}{"name": "v1alpha1", "referenceable": true}},
+	}
+	template := newComposition("redis-template")
+	template.Object["spec"] = map[string]interface{}{
+		"compositeTypeRef": map[string]interface{}{"apiVersion": "syn.tools/v1alpha1", "kind": "CompositeRedisInstance"},
+	}
+	cl := fake.NewClientBuilder().WithObjects(xrd, template).WithInterceptorFuncs(funcs).Build()
+	h := NewAPIHandler(nil, cl, nil, &Config{Namespace: "broker"}, lager.NewLogger("test"))
+
+	sd := &ServiceDefinitionRequest{
+		ID:                          "d9b8ab3e-2f4a-4d51-8b7e-8a1f1c0b0d01",
+		Name:                        "redis-k8s",
+		Description:                 "Redis",
+		CompositeResourceDefinition: "xredis.syn.tools",
+		Plans: []PlanDefinition{
+			{ID: "d9b8ab3e-2f4a-4d51-8b7e-8a1f1c0b0d02", Name: "small", Description: "Small Redis", CompositionRef: "redis-template"},
+			{ID: "d9b8ab3e-2f4a-4d51-8b7e-8a1f1c0b0d03", Name: "large", Description: "Large Redis", CompositionRef: "redis-template"},
+		},
+	}
+	return h, cl, sd
+}
+
+func TestAPIHandler_CreateUpdateServiceDefinition_RemovedPlans(t *testing.T) {
+	h, cl, sd := newTestDefinitionHandler(interceptor.Funcs{})
+	rctx := reqcontext.NewReqContext(context.TODO(), lager.NewLogger("test"), nil)
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+
+	large := sd.Plans[1]
+	sd.Plans = sd.Plans[:1]
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+	comp := newComposition(large.ID)
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(comp), comp))
+	assert.Equal(t, "true", comp.GetLabels()[DeprecatedLabel], "removed plans must be deprecated")
+	assert.Equal(t, sd.ID, comp.GetLabels()[crossplane.ServiceIDLabel])
+
+	sd.Plans = append(sd.Plans, large)
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(comp), comp))
+	assert.NotContains(t, comp.GetLabels(), DeprecatedLabel, "plans added again must not be deprecated anymore")
+}
+
+func TestAPIHandler_CreateUpdateServiceDefinition_Failure(t *testing.T) {
+	h, cl, sd := newTestDefinitionHandler(interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if obj.GetName() == "d9b8ab3e-2f4a-4d51-8b7e-8a1f1c0b0d03" {
+				return errors.New("create failed")
+			}
+			return c.Create(ctx, obj, opts...)
+		},
+	})
+	rctx := reqcontext.NewReqContext(context.TODO(), lager.NewLogger("test"), nil)
+
+	assert.EqualError(t, h.CreateUpdateServiceDefinition(rctx, sd, false), "create failed")
+
+	xrd := newCompositeResourceDefinition("xredis.syn.tools")
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(xrd), xrd))
+	assert.Empty(t, xrd.GetLabels(), "the definition of the service must be reverted")
+	err := cl.Get(context.TODO(), client.ObjectKey{Name: sd.Plans[0].ID}, newComposition(sd.Plans[0].ID))
+	assert.True(t, apierrors.IsNotFound(err), "created plans must be removed again")
+	revisions, err := h.ServiceDefinitionRevisions(rctx, sd.ID)
+	require.NoError(t, err)
+	assert.Empty(t, revisions, "the revision of a definition which couldn't be applied must be removed")
+}
+
+func TestAPIHandler_RecordRevision_Limit(t *testing.T) {
+	h, _, sd := newTestDefinitionHandler(interceptor.Funcs{})
+	rctx := reqcontext.NewReqContext(context.TODO(), lager.NewLogger("test"), nil)
+
+	for i := 0; i < maxRevisions+2; i++ {
+		sd.Description = fmt.Sprintf("Redis %d", i)
+		require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+	}
+	revisions, err := h.ServiceDefinitionRevisions(rctx, sd.ID)
+	require.NoError(t, err)
+	require.Len(t, revisions, maxRevisions)
+	assert.Equal(t, 3, revisions[0].Revision)
+	assert.Equal(t, maxRevisions+2, revisions[len(revisions)-1].Revision)
+}
+
+func TestAPIHandler_RollbackServiceDefinition_Plans(t *testing.T) {
+	h, cl, sd := newTestDefinitionHandler(interceptor.Funcs{})
+	rctx := reqcontext.NewReqContext(context.TODO(), lager.NewLogger("test"), nil)
+	small, large := sd.Plans[0], sd.Plans[1]
+	sd.Plans = []PlanDefinition{small}
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+
+	medium := PlanDefinition{ID: "d9b8ab3e-2f4a-4d51-8b7e-8a1f1c0b0d04", Name: "medium", Description: "Medium Redis", CompositionRef: "redis-template"}
+	sd.Plans = []PlanDefinition{small, medium, large}
+	require.NoError(t, h.CreateUpdateServiceDefinition(rctx, sd, false))
+
+	xr := &unstructured.Unstructured{}
+	xr.SetGroupVersionKind(schema.GroupVersionKind{Group: "syn.tools", Version: "v1alpha1", Kind: "CompositeRedisInstance"})
+	xr.SetName("1-1-1")
+	require.NoError(t, unstructured.SetNestedField(xr.Object, large.ID, "spec", "compositionRef", "name"))
+	require.NoError(t, cl.Create(context.TODO(), xr))
+
+	_, err := h.RollbackServiceDefinition(rctx, sd.ID, 1)
+	require.NoError(t, err)
+
+	err = cl.Get(context.TODO(), client.ObjectKey{Name: medium.ID}, newComposition(medium.ID))
+	assert.True(t, apierrors.IsNotFound(err), "plans added after the revision must be removed")
+	comp := newComposition(large.ID)
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(comp), comp))
+	assert.Equal(t, "true", comp.GetLabels()[DeprecatedLabel], "plans added after the revision which are in use must be deprecated")
+	comp = newComposition(small.ID)
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(comp), comp))
+	assert.NotContains(t, comp.GetLabels(), DeprecatedLabel)
+}
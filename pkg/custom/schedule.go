@@ -0,0 +1,151 @@
+package custom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// BackupScheduleAnnotation holds the backup schedule of an instance on its composite.
+	BackupScheduleAnnotation = crossplane.SynToolsBase + "/backup-schedule"
+	// RetentionPolicyAnnotation holds the retention policy of the scheduled backups on their cron job.
+	RetentionPolicyAnnotation = crossplane.SynToolsBase + "/retention-policy"
+)
+
+// scheduleName returns the name of the cron job taking the scheduled backups of an instance.
+func scheduleName(instanceID string) string {
+	return "schedule-" + instanceID
+}
+
+// scheduleFromInstance returns the backup schedule stored on the instance, nil if there is none.
+func scheduleFromInstance(instance *crossplane.Instance) (*BackupSchedule, error) {
+	a, ok := instance.Composite.GetAnnotations()[BackupScheduleAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	s := &BackupSchedule{}
+	if err := json.Unmarshal([]byte(a), s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// validateSchedule checks the cron expression and requires a schedule to keep at least one backup.
+// Either five cron fields or one of the predefined schedules such as @daily are accepted,
+// the time zone can't be set in the expression.
+func validateSchedule(s *BackupSchedule) error {
+	if s.Schedule == "" {
+		return nil
+	}
+	if strings.HasPrefix(s.Schedule, "TZ=") || strings.HasPrefix(s.Schedule, "CRON_TZ=") {
+		return errors.New("schedule must not contain a time zone")
+	}
+	if _, err := cron.ParseStandard(s.Schedule); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	r := s.Retention
+	if r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 {
+		return errors.New("retention must not be negative")
+	}
+	if r.KeepDaily+r.KeepWeekly+r.KeepMonthly == 0 {
+		return errors.New("retention must keep at least one backup")
+	}
+	return nil
+}
+
+// keptBackups returns the names of the scheduled backups the retention policy keeps: the most recent backup
+// of each of the last KeepDaily days, KeepWeekly weeks and KeepMonthly months with a backup.
+// Only successful backups count, the others are never kept by the policy.
+func keptBackups(jobs []batchv1.Job, r RetentionPolicy) map[string]bool {
+	backups := make([]Backup, 0, len(jobs))
+	for i := range jobs {
+		if b := backupFromJob(&jobs[i], nil); b.Status == OperationSucceeded {
+			backups = append(backups, b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+
+	kept := map[string]bool{}
+	keep := func(n int, bucket func(t time.Time) string) {
+		last := ""
+		for _, b := range backups {
+			if n == 0 {
+				return
+			}
+			if k := bucket(b.CreatedAt.UTC()); k != last {
+				kept[b.ID] = true
+				last = k
+				n--
+			}
+		}
+	}
+	keep(r.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keep(r.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keep(r.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") })
+	return kept
+}
+
+// newBackupCronJob returns the cron job taking backups of the given instance according to the schedule.
+// The BackupPruner removes the backups not covered by the retention policy, stored on the cron job.
+// The cron job is owned by the composite of the instance, which is why it gets removed together with the instance.
+func newBackupCronJob(instance, cluster *crossplane.Instance, s *BackupSchedule, config *Config) (*batchv1.CronJob, error) {
+	job, err := newOperationJob(instance, cluster, operationBackup, scheduleName(instance.ID()), config, nil)
+	if err != nil {
+		return nil, err
+	}
+	job.Labels[BackupTypeLabel] = string(BackupScheduled)
+	policy, err := json.Marshal(s.Retention)
+	if err != nil {
+		return nil, err
+	}
+
+	// Jobs are the backups listed by the API. The cron job must not remove successful ones, the BackupPruner
+	// removes them together with their stored data once the retention policy no longer covers them.
+	successfulJobs := int32(math.MaxInt32)
+	failedJobs := int32(1)
+
+	gvk := instance.Composite.GetObjectKind().GroupVersionKind()
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        job.Name,
+			Namespace:   job.Namespace,
+			Labels:      job.Labels,
+			Annotations: map[string]string{RetentionPolicyAnnotation: string(policy)},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: gvk.GroupVersion().String(),
+					Kind:       gvk.Kind,
+					Name:       instance.Composite.GetName(),
+					UID:        instance.Composite.GetUID(),
+				},
+			},
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   s.Schedule,
+			ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &successfulJobs,
+			FailedJobsHistoryLimit:     &failedJobs,
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: job.Labels,
+				},
+				Spec: job.Spec,
+			},
+		},
+	}, nil
+}
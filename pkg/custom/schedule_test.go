@@ -0,0 +1,153 @@
+package custom
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/reqcontext"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule BackupSchedule
+		wantErr  string
+	}{
+		{
+			name:     "empty schedule disables backups",
+			schedule: BackupSchedule{},
+		},
+		{
+			name:     "cron expression",
+			schedule: BackupSchedule{Schedule: "0 2 * * *", Retention: RetentionPolicy{KeepDaily: 7}},
+		},
+		{
+			name:     "predefined schedule",
+			schedule: BackupSchedule{Schedule: "@daily", Retention: RetentionPolicy{KeepDaily: 7, KeepMonthly: 3}},
+		},
+		{
+			name:     "invalid cron expression",
+			schedule: BackupSchedule{Schedule: "0 2 * *", Retention: RetentionPolicy{KeepDaily: 7}},
+			wantErr:  "invalid schedule: expected exactly 5 fields",
+		},
+		{
+			name:     "invalid cron field",
+			schedule: BackupSchedule{Schedule: "0 25 * * *", Retention: RetentionPolicy{KeepDaily: 7}},
+			wantErr:  "invalid schedule",
+		},
+		{
+			name:     "unknown predefined schedule",
+			schedule: BackupSchedule{Schedule: "@fortnightly", Retention: RetentionPolicy{KeepDaily: 7}},
+			wantErr:  "invalid schedule",
+		},
+		{
+			name:     "time zone",
+			schedule: BackupSchedule{Schedule: "CRON_TZ=Europe/Zurich 0 2 * * *", Retention: RetentionPolicy{KeepDaily: 7}},
+			wantErr:  "schedule must not contain a time zone",
+		},
+		{
+			name:     "requires retention",
+			schedule: BackupSchedule{Schedule: "@daily"},
+			wantErr:  "retention must keep at least one backup",
+		},
+		{
+			name:     "negative retention",
+			schedule: BackupSchedule{Schedule: "@daily", Retention: RetentionPolicy{KeepDaily: 7, KeepWeekly: -1}},
+			wantErr:  "retention must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSchedule(&tt.schedule)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// newScheduledBackupJobs returns a succeeded scheduled backup of instance 1-1-1 for every day before now.
+func newScheduledBackupJobs(now time.Time, days int) []batchv1.Job {
+	jobs := make([]batchv1.Job, 0, days)
+	for d := 0; d < days; d++ {
+		created := now.AddDate(0, 0, -d)
+		job := newFinishedBackupJob(fmt.Sprintf("schedule-1-1-1-%s", created.Format("20060102")), created.Add(time.Minute), nil)
+		job.CreationTimestamp = metav1.Time{Time: created}
+		job.Labels[BackupTypeLabel] = string(BackupScheduled)
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func TestKeptBackups(t *testing.T) {
+	// Wednesday
+	now := time.Date(2021, 3, 10, 2, 0, 0, 0, time.UTC)
+	jobs := newScheduledBackupJobs(now, 70)
+	failed := newFinishedBackupJob("schedule-1-1-1-failed", now.Add(time.Hour), nil)
+	failed.CreationTimestamp = metav1.Time{Time: now.Add(time.Hour)}
+	failed.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	jobs = append(jobs, *failed)
+
+	kept := keptBackups(jobs, RetentionPolicy{KeepDaily: 3, KeepWeekly: 2, KeepMonthly: 3})
+	assert.Equal(t, map[string]bool{
+		// daily
+		"schedule-1-1-1-20210310": true,
+		"schedule-1-1-1-20210309": true,
+		"schedule-1-1-1-20210308": true,
+		// weekly, the most recent backup of this week is kept daily
+		"schedule-1-1-1-20210307": true,
+		// monthly, the most recent backup of this month is kept daily
+		"schedule-1-1-1-20210228": true,
+		"schedule-1-1-1-20210131": true,
+	}, kept)
+}
+
+func TestAPIHandler_SetBackupSchedule_Remove(t *testing.T) {
+	now := time.Now()
+	schedule := &batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Namespace: "crossplane", Name: scheduleName("1-1-1")}}
+	jobs := newScheduledBackupJobs(now, 2)
+	retained := &jobs[1]
+	retained.Annotations = map[string]string{RetentionAnnotation: "1h"}
+	h, cl := newTestBackupHandler(schedule, &jobs[0], retained)
+	h.config.BackupRetention = 24 * time.Hour
+	var propagation *metav1.DeletionPropagation
+	h.client = interceptor.NewClient(cl.(client.WithWatch), interceptor.Funcs{
+		Delete: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.DeleteOption) error {
+			o := &client.DeleteOptions{}
+			o.ApplyOptions(opts)
+			propagation = o.PropagationPolicy
+			return c.Delete(ctx, obj, opts...)
+		},
+	})
+	rctx := reqcontext.NewReqContext(adminContext(), lager.NewLogger("test"), nil)
+
+	_, err := h.SetBackupSchedule(rctx, "1-1-1", &BackupSchedule{})
+	require.NoError(t, err)
+	err = cl.Get(context.TODO(), client.ObjectKeyFromObject(schedule), &batchv1.CronJob{})
+	assert.True(t, apierrors.IsNotFound(err), "schedule must be removed")
+	require.NotNil(t, propagation)
+	assert.Equal(t, metav1.DeletePropagationOrphan, *propagation, "scheduled backups must not be garbage collected")
+
+	job := &batchv1.Job{}
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(&jobs[0]), job))
+	assert.Equal(t, "24h0m0s", job.Annotations[RetentionAnnotation], "scheduled backups must get the retention of manual backups")
+	require.NoError(t, cl.Get(context.TODO(), client.ObjectKeyFromObject(retained), job))
+	assert.Equal(t, "1h", job.Annotations[RetentionAnnotation])
+
+	backups, err := h.ListBackups(rctx, "1-1-1")
+	require.NoError(t, err)
+	assert.Len(t, backups.Backups, 2)
+}
@@ -0,0 +1,233 @@
+package custom
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// DeprecatedLabel marks the compositions of deprecated plans.
+	DeprecatedLabel = crossplane.SynToolsBase + "/deprecated"
+	// SchemasAnnotation holds the JSON schemas of the parameters of a plan on its composition.
+	SchemasAnnotation = crossplane.SynToolsBase + "/schemas"
+)
+
+var (
+	// compositeResourceDefinitionGVK is the kind of the objects defining services.
+	compositeResourceDefinitionGVK = schema.GroupVersionKind{Group: "apiextensions.crossplane.io", Version: "v1", Kind: "CompositeResourceDefinition"}
+	// compositionGVK is the kind of the objects defining plans.
+	compositionGVK = schema.GroupVersionKind{Group: "apiextensions.crossplane.io", Version: "v1", Kind: "Composition"}
+)
+
+func newCompositeResourceDefinition(name string) *unstructured.Unstructured {
+	xrd := &unstructured.Unstructured{}
+	xrd.SetGroupVersionKind(compositeResourceDefinitionGVK)
+	xrd.SetName(name)
+	return xrd
+}
+
+func newComposition(name string) *unstructured.Unstructured {
+	comp := &unstructured.Unstructured{}
+	comp.SetGroupVersionKind(compositionGVK)
+	comp.SetName(name)
+	return comp
+}
+
+// newList returns a list of objects of the given kind.
+func newList(gvk schema.GroupVersionKind) *unstructured.UnstructuredList {
+	l := &unstructured.UnstructuredList{}
+	l.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	return l
+}
+
+// applyServiceDefinition sets the labels and annotations the catalog is built from on the definition of the service.
+// The service is only listed in the catalog if its ID is one of the service IDs the broker is configured with.
+func applyServiceDefinition(xrd *unstructured.Unstructured, sd *ServiceDefinitionRequest) error {
+	labels := xrd.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[crossplane.ServiceIDLabel] = sd.ID
+	labels[crossplane.ServiceNameLabel] = sd.Name
+	labels[crossplane.BindableLabel] = strconv.FormatBool(sd.Bindable)
+	labels[crossplane.UpdatableLabel] = strconv.FormatBool(sd.PlanUpdatable)
+	xrd.SetLabels(labels)
+
+	annotations := xrd.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[crossplane.DescriptionAnnotation] = sd.Description
+	if err := setJSONAnnotation(annotations, crossplane.MetadataAnnotation, sd.Metadata); err != nil {
+		return err
+	}
+	if len(sd.Tags) > 0 {
+		tags, err := json.Marshal(sd.Tags)
+		if err != nil {
+			return err
+		}
+		annotations[crossplane.TagsAnnotation] = string(tags)
+	} else {
+		delete(annotations, crossplane.TagsAnnotation)
+	}
+	xrd.SetAnnotations(annotations)
+	return nil
+}
+
+// applyPlanDefinition copies the spec of the template to the composition of the plan and sets the labels
+// and annotations the catalog is built from.
+func applyPlanDefinition(comp, template *unstructured.Unstructured, sd *ServiceDefinitionRequest, plan *PlanDefinition) error {
+	spec, ok := template.Object["spec"]
+	if !ok {
+		return fmt.Errorf("composition %q has no spec", template.GetName())
+	}
+	comp.Object["spec"] = runtime.DeepCopyJSONValue(spec)
+
+	bindable := sd.Bindable
+	if plan.Bindable != nil {
+		bindable = *plan.Bindable
+	}
+	updatable := sd.PlanUpdatable
+	if plan.Updatable != nil {
+		updatable = *plan.Updatable
+	}
+
+	labels := comp.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[crossplane.ServiceIDLabel] = sd.ID
+	labels[crossplane.ServiceNameLabel] = sd.Name
+	labels[crossplane.PlanNameLabel] = plan.Name
+	labels[crossplane.BindableLabel] = strconv.FormatBool(bindable)
+	labels[crossplane.UpdatableLabel] = strconv.FormatBool(updatable)
+	if plan.SLA != "" {
+		labels[crossplane.SLALabel] = plan.SLA
+	} else {
+		delete(labels, crossplane.SLALabel)
+	}
+	if plan.Deprecated {
+		labels[DeprecatedLabel] = "true"
+	} else {
+		delete(labels, DeprecatedLabel)
+	}
+	comp.SetLabels(labels)
+
+	annotations := comp.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[crossplane.DescriptionAnnotation] = plan.Description
+	if err := setJSONAnnotation(annotations, crossplane.MetadataAnnotation, plan.Metadata); err != nil {
+		return err
+	}
+	if plan.Schemas != nil {
+		schemas, err := json.Marshal(plan.Schemas)
+		if err != nil {
+			return err
+		}
+		annotations[SchemasAnnotation] = string(schemas)
+	} else {
+		delete(annotations, SchemasAnnotation)
+	}
+	comp.SetAnnotations(annotations)
+	return nil
+}
+
+// deprecatePlan marks the composition of a plan which is not part of the service definition anymore as deprecated.
+func deprecatePlan(comp *unstructured.Unstructured) {
+	labels := comp.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[DeprecatedLabel] = "true"
+	comp.SetLabels(labels)
+}
+
+// setJSONAnnotation stores the compacted JSON value in the annotation, or removes the annotation if there is no value.
+func setJSONAnnotation(annotations map[string]string, key string, value json.RawMessage) error {
+	if len(value) == 0 || string(value) == "null" {
+		delete(annotations, key)
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return err
+	}
+	annotations[key] = buf.String()
+	return nil
+}
+
+// removeServiceDefinition removes the labels and annotations the catalog is built from from the definition of a service.
+func removeServiceDefinition(xrd *unstructured.Unstructured) {
+	labels := xrd.GetLabels()
+	for _, l := range []string{crossplane.ServiceIDLabel, crossplane.ServiceNameLabel, crossplane.BindableLabel, crossplane.UpdatableLabel} {
+		delete(labels, l)
+	}
+	xrd.SetLabels(labels)
+
+	annotations := xrd.GetAnnotations()
+	for _, a := range []string{crossplane.DescriptionAnnotation, crossplane.MetadataAnnotation, crossplane.TagsAnnotation} {
+		delete(annotations, a)
+	}
+	xrd.SetAnnotations(annotations)
+}
+
+// compositeGVK returns the kind of the composites a definition defines, using the referenceable version.
+func compositeGVK(xrd *unstructured.Unstructured) (schema.GroupVersionKind, error) {
+	group, _, _ := unstructured.NestedString(xrd.Object, "spec", "group")
+	versions, _, _ := unstructured.NestedSlice(xrd.Object, "spec", "versions")
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if referenceable, _, _ := unstructured.NestedBool(version, "referenceable"); referenceable {
+			name, _, _ := unstructured.NestedString(version, "name")
+			return schema.GroupVersionKind{Group: group, Version: name, Kind: compositeKind(xrd)}, nil
+		}
+	}
+	return schema.GroupVersionKind{}, fmt.Errorf("composite resource definition %q has no referenceable version", xrd.GetName())
+}
+
+// usedByInstances returns the sorted IDs of the composites which aren't being deleted and are matched by the filter.
+func usedByInstances(composites []unstructured.Unstructured, filter func(*unstructured.Unstructured) bool) []string {
+	ids := []string{}
+	for i := range composites {
+		c := &composites[i]
+		if c.GetDeletionTimestamp() != nil || c.GetLabels()[crossplane.DeletedLabel] == "true" {
+			continue
+		}
+		if filter(c) {
+			ids = append(ids, c.GetName())
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// compositionName returns the name of the composition the composite has been composed with.
+func compositionName(composite *unstructured.Unstructured) string {
+	name, _, _ := unstructured.NestedString(composite.Object, "spec", "compositionRef", "name")
+	return name
+}
+
+// compositeKind returns the kind of the composites a definition defines.
+func compositeKind(xrd *unstructured.Unstructured) string {
+	kind, _, _ := unstructured.NestedString(xrd.Object, "spec", "names", "kind")
+	return kind
+}
+
+// compositionCompositeKind returns the kind of the composites a composition composes.
+func compositionCompositeKind(comp *unstructured.Unstructured) string {
+	kind, _, _ := unstructured.NestedString(comp.Object, "spec", "compositeTypeRef", "kind")
+	return kind
+}
@@ -0,0 +1,114 @@
+package custom
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestApplyServiceDefinition(t *testing.T) {
+	xrd := newCompositeResourceDefinition("xredis.syn.tools")
+	xrd.SetLabels(map[string]string{"other": "label"})
+	xrd.SetAnnotations(map[string]string{crossplane.TagsAnnotation: `["old"]`})
+
+	require.NoError(t, applyServiceDefinition(xrd, &ServiceDefinitionRequest{
+		ID:            "1",
+		Name:          "redis-k8s",
+		Description:   "Redis",
+		Bindable:      true,
+		PlanUpdatable: false,
+		Metadata:      json.RawMessage(`{ "displayName": "Redis" }`),
+	}))
+
+	assert.Equal(t, map[string]string{
+		"other":                     "label",
+		crossplane.ServiceIDLabel:   "1",
+		crossplane.ServiceNameLabel: "redis-k8s",
+		crossplane.BindableLabel:    "true",
+		crossplane.UpdatableLabel:   "false",
+	}, xrd.GetLabels())
+	assert.Equal(t, map[string]string{
+		crossplane.DescriptionAnnotation: "Redis",
+		crossplane.MetadataAnnotation:    `{"displayName":"Redis"}`,
+	}, xrd.GetAnnotations())
+}
+
+func TestApplyPlanDefinition(t *testing.T) {
+	template := newComposition("redis-template")
+	template.Object["spec"] = map[string]interface{}{
+		"compositeTypeRef": map[string]interface{}{"apiVersion": "syn.tools/v1alpha1", "kind": "CompositeRedisInstance"},
+	}
+	comp := newComposition("1-1")
+	comp.SetLabels(map[string]string{crossplane.SLALabel: "premium"})
+
+	bindable := false
+	sd := &ServiceDefinitionRequest{ID: "1", Name: "redis-k8s", Bindable: true, PlanUpdatable: true}
+	require.NoError(t, applyPlanDefinition(comp, template, sd, &PlanDefinition{
+		ID:             "1-1",
+		Name:           "small",
+		Description:    "Small Redis",
+		Bindable:       &bindable,
+		CompositionRef: "redis-template",
+	}))
+
+	assert.Equal(t, "CompositeRedisInstance", compositionCompositeKind(comp))
+	assert.Equal(t, map[string]string{
+		crossplane.ServiceIDLabel:   "1",
+		crossplane.ServiceNameLabel: "redis-k8s",
+		crossplane.PlanNameLabel:    "small",
+		crossplane.BindableLabel:    "false",
+		crossplane.UpdatableLabel:   "true",
+	}, comp.GetLabels())
+	assert.Equal(t, map[string]string{
+		crossplane.DescriptionAnnotation: "Small Redis",
+	}, comp.GetAnnotations())
+
+	// The spec must be copied, not shared with the template
+	comp.Object["spec"].(map[string]interface{})["compositeTypeRef"] = nil
+	assert.Equal(t, "CompositeRedisInstance", compositionCompositeKind(template))
+}
+
+func TestUsedByInstances(t *testing.T) {
+	newComposite := func(name, plan string, labels map[string]string) unstructured.Unstructured {
+		c := unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"compositionRef": map[string]interface{}{"name": plan}},
+		}}
+		c.SetName(name)
+		c.SetLabels(labels)
+		return c
+	}
+	composites := []unstructured.Unstructured{
+		newComposite("1-1-2", "1-1", nil),
+		newComposite("1-2-1", "1-2", nil),
+		newComposite("1-1-1", "1-1", nil),
+		newComposite("1-1-3", "1-1", map[string]string{crossplane.DeletedLabel: "true"}),
+	}
+
+	assert.Equal(t, []string{"1-1-1", "1-1-2"}, usedByInstances(composites, func(c *unstructured.Unstructured) bool {
+		return compositionName(c) == "1-1"
+	}))
+	assert.Equal(t, []string{}, usedByInstances(composites, func(c *unstructured.Unstructured) bool {
+		return compositionName(c) == "1-3"
+	}))
+}
+
+func TestCompositeGVK(t *testing.T) {
+	xrd := newCompositeResourceDefinition("xredis.syn.tools")
+	xrd.Object["spec"] = map[string]interface{}{
+		"group": "syn.tools",
+		"names": map[string]interface{}{"kind": "CompositeRedisInstance"},
+		"versions": []interface{}{
+			map[string]interface{}{"name": "v1alpha1", "referenceable": false},
+			map[string]interface{}{"name": "v1", "referenceable": true},
+		},
+	}
+
+	gvk, err := compositeGVK(xrd)
+	require.NoError(t, err)
+	assert.Equal(t, schema.GroupVersionKind{Group: "syn.tools", Version: "v1", Kind: "CompositeRedisInstance"}, gvk)
+}
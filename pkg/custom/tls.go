@@ -0,0 +1,95 @@
+package custom
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TLSRequiredKey is the connection detail set to "true" if the instance only accepts TLS connections.
+	TLSRequiredKey = "tlsRequired"
+	// TLSPortKey is the connection detail holding the port accepting TLS connections, if it differs from the port.
+	TLSPortKey = "tlsPort"
+	// SentinelTLSPortKey is the connection detail holding the port of Redis Sentinel accepting TLS connections.
+	SentinelTLSPortKey = "sentinelTLSPort"
+	// CACertificateKey is the connection detail holding the PEM encoded CA certificate the server certificate is signed by.
+	CACertificateKey = "ca.crt"
+	// CAFingerprintKey is the connection detail holding the SHA-256 fingerprint of the CA certificate,
+	// used if the certificate itself isn't part of the connection details.
+	CAFingerprintKey = "caFingerprint"
+)
+
+// endpointTLS returns the TLS configuration of an endpoint from the connection details,
+// nil if the instance doesn't support TLS. The TLS port is taken from the given key and defaults to the port.
+func endpointTLS(data map[string][]byte, portKey, port string) (*EndpointTLS, error) {
+	required := string(data[TLSRequiredKey])
+	tlsPort := string(data[portKey])
+	ca := data[CACertificateKey]
+	fingerprint := string(data[CAFingerprintKey])
+	if required == "" && tlsPort == "" && len(ca) == 0 && fingerprint == "" {
+		return nil, nil
+	}
+
+	t := &EndpointTLS{Port: tlsPort, CAFingerprint: fingerprint}
+	if required != "" {
+		r, err := strconv.ParseBool(required)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", TLSRequiredKey, err)
+		}
+		t.Required = r
+	}
+	if t.Port == "" {
+		t.Port = port
+	}
+	if len(ca) > 0 {
+		f, err := certificateFingerprint(ca)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", CACertificateKey, err)
+		}
+		t.CACertificate = string(ca)
+		t.CAFingerprint = f
+	}
+	return t, nil
+}
+
+// dialTarget returns the address the broker connects to an endpoint at and the TLS configuration to connect with,
+// which is nil unless the endpoint requires TLS. The server certificate is verified with the CA certificate of the
+// connection details, or with the system roots if they don't contain it.
+func dialTarget(e Endpoint) (string, *tls.Config, error) {
+	if e.TLS == nil || !e.TLS.Required {
+		return net.JoinHostPort(e.Destination, e.Ports), nil, nil
+	}
+	cfg := &tls.Config{ServerName: e.Destination, MinVersion: tls.VersionTLS12}
+	if e.TLS.CACertificate != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(e.TLS.CACertificate)) {
+			return "", nil, fmt.Errorf("invalid %s: no valid certificate found", CACertificateKey)
+		}
+		cfg.RootCAs = pool
+	}
+	return net.JoinHostPort(e.Destination, e.TLS.Port), cfg, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint of the first certificate of a PEM bundle,
+// formatted as colon separated uppercase hex the way openssl prints it.
+func certificateFingerprint(bundle []byte) (string, error) {
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return "", errors.New("no PEM encoded certificate found")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		sum := sha256.Sum256(block.Bytes)
+		return strings.ReplaceAll(fmt.Sprintf("% X", sum), " ", ":"), nil
+	}
+}
@@ -0,0 +1,128 @@
+package custom
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCACertificate(t *testing.T) ([]byte, string) {
+	ca, _, fingerprint := newTestCA(t)
+	return ca, fingerprint
+}
+
+func newTestCA(t *testing.T) ([]byte, tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(der)
+	fingerprint := strings.ReplaceAll(fmt.Sprintf("% X", sum), " ", ":")
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, fingerprint
+}
+
+// newTestServerTLSConfig returns the TLS configuration of a server on 127.0.0.1 and the CA certificate its certificate is signed by.
+func newTestServerTLSConfig(t *testing.T) (*tls.Config, []byte) {
+	caPEM, ca, _ := newTestCA(t)
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, caPEM
+}
+
+func TestEndpointTLS(t *testing.T) {
+	ca, fingerprint := newTestCACertificate(t)
+
+	tests := map[string]struct {
+		data    map[string][]byte
+		want    *EndpointTLS
+		wantErr string
+	}{
+		"no tls": {
+			data: map[string][]byte{"port": []byte("6379")},
+		},
+		"required with certificate": {
+			data: map[string][]byte{TLSRequiredKey: []byte("true"), TLSPortKey: []byte("6380"), CACertificateKey: ca},
+			want: &EndpointTLS{Required: true, Port: "6380", CACertificate: string(ca), CAFingerprint: fingerprint},
+		},
+		"fingerprint only on the same port": {
+			data: map[string][]byte{CAFingerprintKey: []byte("AB:CD")},
+			want: &EndpointTLS{Port: "6379", CAFingerprint: "AB:CD"},
+		},
+		"invalid certificate": {
+			data:    map[string][]byte{CACertificateKey: []byte("ca")},
+			wantErr: "invalid ca.crt: no PEM encoded certificate found",
+		},
+		"invalid required": {
+			data:    map[string][]byte{TLSRequiredKey: []byte("yes please")},
+			wantErr: `invalid tlsRequired: strconv.ParseBool: parsing "yes please": invalid syntax`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := endpointTLS(tt.data, TLSPortKey, "6379")
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDialTarget(t *testing.T) {
+	ca, _ := newTestCACertificate(t)
+
+	addr, tlsConfig, err := dialTarget(Endpoint{Destination: "redis", Ports: "6379", TLS: &EndpointTLS{Port: "6380"}})
+	require.NoError(t, err)
+	assert.Equal(t, "redis:6379", addr, "endpoints which accept plaintext connections are connected to without TLS")
+	assert.Nil(t, tlsConfig)
+
+	addr, tlsConfig, err = dialTarget(Endpoint{Destination: "redis", Ports: "6379", TLS: &EndpointTLS{Required: true, Port: "6380", CACertificate: string(ca)}})
+	require.NoError(t, err)
+	assert.Equal(t, "redis:6380", addr)
+	require.NotNil(t, tlsConfig)
+	assert.Equal(t, "redis", tlsConfig.ServerName)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+
+	_, _, err = dialTarget(Endpoint{Destination: "redis", TLS: &EndpointTLS{Required: true, CACertificate: "ca"}})
+	assert.EqualError(t, err, "invalid ca.crt: no valid certificate found")
+}
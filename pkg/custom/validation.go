@@ -0,0 +1,249 @@
+package custom
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pivotal-cf/brokerapi/v8/domain"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/vshn/crossplane-service-broker/pkg/crossplane"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// maxDescriptionLength is the longest description the marketplace accepts.
+	maxDescriptionLength = 255
+	// maxTagLength is the longest tag the marketplace accepts.
+	maxTagLength = 63
+)
+
+// cliFriendlyName matches names which are lowercase, contain no spaces and can be used as label values.
+var cliFriendlyName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9._]*[a-z0-9])?$`)
+
+// validationError lists all violations of a request.
+type validationError struct {
+	violations []string
+}
+
+func (e *validationError) Error() string {
+	return "service definition is invalid: " + strings.Join(e.violations, "; ")
+}
+
+// serviceDefinitionValidator collects the violations of a service definition.
+type serviceDefinitionValidator struct {
+	violations []string
+}
+
+func (v *serviceDefinitionValidator) addf(format string, args ...interface{}) {
+	v.violations = append(v.violations, fmt.Sprintf(format, args...))
+}
+
+// validateServiceDefinition checks the definition against the constraints of the open service broker API spec,
+// the marketplace and the plan update rules the broker is configured with.
+// All violations are returned, nil if there are none.
+func validateServiceDefinition(sd *ServiceDefinitionRequest, config *Config) error {
+	v := &serviceDefinitionValidator{}
+
+	ids := map[string]string{}
+	v.validateID("id", sd.ID, ids)
+	v.validateName("name", sd.Name)
+	v.validateDescription("description", sd.Description)
+	if sd.CompositeResourceDefinition == "" {
+		v.addf("composite_resource_definition: must not be empty")
+	}
+	for i, tag := range sd.Tags {
+		if tag == "" || len(tag) > maxTagLength {
+			v.addf("tags[%d]: must be between 1 and %d characters", i, maxTagLength)
+		}
+	}
+	v.validateMetadata("metadata", sd.Metadata)
+
+	if len(sd.Plans) == 0 {
+		v.addf("plans: a service must have at least one plan")
+	}
+	names := map[string]bool{}
+	for i, p := range sd.Plans {
+		path := fmt.Sprintf("plans[%d]", i)
+		v.validateID(path+".id", p.ID, ids)
+		v.validateName(path+".name", p.Name)
+		if names[p.Name] {
+			v.addf("%s.name: %q is used by more than one plan", path, p.Name)
+		}
+		names[p.Name] = true
+		v.validateDescription(path+".description", p.Description)
+		v.validateMetadata(path+".metadata", p.Metadata)
+		if p.SLA != "" && len(validation.IsValidLabelValue(p.SLA)) > 0 {
+			v.addf("%s.sla: %q is not a valid label value", path, p.SLA)
+		}
+		if p.CompositionRef == "" {
+			v.addf("%s.composition_ref: must not be empty", path)
+		}
+		if p.Schemas != nil {
+			v.validateSchemas(path+".schemas", p.Schemas)
+		}
+	}
+
+	v.validatePlanUpdateRules(sd, config)
+
+	if len(v.violations) > 0 {
+		return &validationError{violations: v.violations}
+	}
+	return nil
+}
+
+// validateID requires IDs to be UUIDs which are unique across the service and its plans.
+// IDs are used as object names, which is why they must be lowercase.
+func (v *serviceDefinitionValidator) validateID(path, id string, seen map[string]string) {
+	if _, err := uuid.Parse(id); err != nil || len(id) != 36 {
+		v.addf("%s: %q is not a valid UUID", path, id)
+	} else if id != strings.ToLower(id) {
+		v.addf("%s: %q must be lowercase", path, id)
+	}
+	if other, ok := seen[id]; ok && id != "" {
+		v.addf("%s: %q is already used by %s", path, id, other)
+		return
+	}
+	seen[id] = path
+}
+
+func (v *serviceDefinitionValidator) validateName(path, name string) {
+	switch {
+	case name == "":
+		v.addf("%s: must not be empty", path)
+	case len(name) > validation.LabelValueMaxLength:
+		v.addf("%s: must be at most %d characters", path, validation.LabelValueMaxLength)
+	case !cliFriendlyName.MatchString(name):
+		v.addf("%s: %q must consist of lowercase alphanumeric characters, '-', '_' or '.'", path, name)
+	}
+}
+
+func (v *serviceDefinitionValidator) validateDescription(path, description string) {
+	switch {
+	case description == "":
+		v.addf("%s: must not be empty", path)
+	case len(description) > maxDescriptionLength:
+		v.addf("%s: must be at most %d characters", path, maxDescriptionLength)
+	}
+}
+
+func (v *serviceDefinitionValidator) validateMetadata(path string, metadata json.RawMessage) {
+	if len(metadata) == 0 || string(metadata) == "null" {
+		return
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(metadata, &m); err != nil {
+		v.addf("%s: must be a JSON object", path)
+	}
+}
+
+func (v *serviceDefinitionValidator) validateSchemas(path string, s *domain.ServiceSchemas) {
+	schemas := map[string]map[string]interface{}{
+		path + ".service_instance.create.parameters": s.Instance.Create.Parameters,
+		path + ".service_instance.update.parameters": s.Instance.Update.Parameters,
+		path + ".service_binding.create.parameters":  s.Binding.Create.Parameters,
+	}
+	for p, schema := range schemas {
+		if schema == nil {
+			continue
+		}
+		if _, ok := schema["$schema"].(string); !ok {
+			v.addf("%s: must declare the JSON schema version in $schema", p)
+		}
+		if t, ok := schema["type"]; ok && t != "object" {
+			v.addf("%s.type: parameters must be described by an object", p)
+		}
+		v.compileSchema(p, schema)
+	}
+}
+
+// compileSchema compiles the schema to make sure it is valid JSON schema, which is checked against the meta schema
+// of the declared version. Schemas without a version are compiled as draft 4, the version the spec requires.
+func (v *serviceDefinitionValidator) compileSchema(path string, schema map[string]interface{}) {
+	raw, err := json.Marshal(schema)
+	if err != nil {
+		v.addf("%s: %s", path, err)
+		return
+	}
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft4
+	if err := c.AddResource("parameters.json", bytes.NewReader(raw)); err != nil {
+		v.addf("%s: %s", path, err)
+		return
+	}
+	_, err = c.Compile("parameters.json")
+	var schemaErr *jsonschema.SchemaError
+	if err == nil || !errors.As(err, &schemaErr) {
+		if err != nil {
+			v.addf("%s: %s", path, err)
+		}
+		return
+	}
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(schemaErr.Err, &validationErr) {
+		v.addf("%s: %s", path, schemaErr.Err)
+		return
+	}
+	reported := map[string]bool{}
+	v.addSchemaViolations(path, validationErr, reported)
+}
+
+// addSchemaViolations adds the innermost causes of a meta schema validation error, one per location in the schema.
+func (v *serviceDefinitionValidator) addSchemaViolations(path string, err *jsonschema.ValidationError, reported map[string]bool) {
+	if len(err.Causes) > 0 {
+		for _, cause := range err.Causes {
+			v.addSchemaViolations(path, cause, reported)
+		}
+		return
+	}
+	location := path + strings.ReplaceAll(err.InstanceLocation, "/", ".")
+	if reported[location] {
+		return
+	}
+	reported[location] = true
+	v.addf("%s: %s", location, err.Message)
+}
+
+// validatePlanUpdateRules ensures the plans of an updatable service can actually be changed according to
+// the plan update rules of the broker, which requires their size and SLA to be part of the rules.
+func (v *serviceDefinitionValidator) validatePlanUpdateRules(sd *ServiceDefinitionRequest, config *Config) {
+	if _, err := crossplane.ParsePlanUpdateRules(config.PlanUpdateSizeRule, config.PlanUpdateSLARule); err != nil {
+		v.addf("plan update rules of the broker are invalid: %s", err)
+		return
+	}
+	sizes := planUpdateRuleTerms(config.PlanUpdateSizeRule)
+	slas := planUpdateRuleTerms(config.PlanUpdateSLARule)
+	for i, p := range sd.Plans {
+		updatable := sd.PlanUpdatable
+		if p.Updatable != nil {
+			updatable = *p.Updatable
+		}
+		if !updatable {
+			continue
+		}
+		// The plan name is the size of the instances, see crossplane.PlanNameLabel.
+		if config.PlanUpdateSizeRule != "" && p.Name != "" && !sizes[p.Name] {
+			v.addf("plans[%d].name: %q is not part of the plan update rules, the plan can't be updated", i, p.Name)
+		}
+		if config.PlanUpdateSLARule != "" && p.SLA != "" && !slas[p.SLA] {
+			v.addf("plans[%d].sla: %q is not part of the plan update rules, the plan can't be updated", i, p.SLA)
+		}
+	}
+}
+
+// planUpdateRuleTerms returns the terms of a plan update rule such as "standard>premium|premium>standard".
+func planUpdateRuleTerms(rule string) map[string]bool {
+	terms := map[string]bool{}
+	for _, transition := range strings.Split(rule, "|") {
+		for _, t := range strings.Split(transition, ">") {
+			if t = strings.TrimSpace(t); t != "" {
+				terms[t] = true
+			}
+		}
+	}
+	return terms
+}
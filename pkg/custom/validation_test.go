@@ -0,0 +1,169 @@
+package custom
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/v8/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServiceDefinition() *ServiceDefinitionRequest {
+	updatable := true
+	return &ServiceDefinitionRequest{
+		ID:                          "8b3f7c52-1a3e-4f0c-9d55-1d2b6a1f0a01",
+		Name:                        "redis-k8s",
+		Description:                 "Redis",
+		CompositeResourceDefinition: "xredis.syn.tools",
+		Tags:                        []string{"redis"},
+		Metadata:                    json.RawMessage(`{"displayName":"Redis"}`),
+		Plans: []PlanDefinition{
+			{
+				ID:             "8b3f7c52-1a3e-4f0c-9d55-1d2b6a1f0a02",
+				Name:           "small",
+				Description:    "Small Redis",
+				SLA:            "standard",
+				Updatable:      &updatable,
+				CompositionRef: "redis-small",
+				Schemas: &domain.ServiceSchemas{Instance: domain.ServiceInstanceSchema{
+					Create: domain.Schema{Parameters: map[string]interface{}{
+						"$schema": "http://json-schema.org/draft-04/schema#",
+						"type":    "object",
+						"properties": map[string]interface{}{
+							"maxmemory": map[string]interface{}{"type": "integer", "minimum": float64(0)},
+						},
+						"required": []interface{}{"maxmemory"},
+					}},
+				}},
+			},
+		},
+	}
+}
+
+func TestValidateServiceDefinition(t *testing.T) {
+	tests := map[string]struct {
+		modify         func(sd *ServiceDefinitionRequest)
+		config         Config
+		wantViolations []string
+	}{
+		"valid": {
+			modify: func(sd *ServiceDefinitionRequest) {},
+			config: Config{PlanUpdateSizeRule: "small>medium|medium>small", PlanUpdateSLARule: "standard>premium|premium>standard"},
+		},
+		"ids": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.ID = "1"
+				sd.Plans = append(sd.Plans, sd.Plans[0])
+				sd.Plans[1].Name = "medium"
+				sd.Plans[0].ID = "8B3F7C52-1A3E-4F0C-9D55-1D2B6A1F0A02"
+			},
+			wantViolations: []string{
+				`id: "1" is not a valid UUID`,
+				`plans[0].id: "8B3F7C52-1A3E-4F0C-9D55-1D2B6A1F0A02" must be lowercase`,
+			},
+		},
+		"duplicate ids and names": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.Plans = append(sd.Plans, sd.Plans[0])
+			},
+			wantViolations: []string{
+				`plans[1].id: "8b3f7c52-1a3e-4f0c-9d55-1d2b6a1f0a02" is already used by plans[0].id`,
+				`plans[1].name: "small" is used by more than one plan`,
+			},
+		},
+		"names, descriptions and references": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.Name = "Redis K8s"
+				sd.Description = strings.Repeat("a", 256)
+				sd.CompositeResourceDefinition = ""
+				sd.Plans[0].Name = ""
+				sd.Plans[0].Description = ""
+				sd.Plans[0].CompositionRef = ""
+				sd.Metadata = json.RawMessage(`[]`)
+			},
+			wantViolations: []string{
+				`name: "Redis K8s" must consist of lowercase alphanumeric characters, '-', '_' or '.'`,
+				"description: must be at most 255 characters",
+				"composite_resource_definition: must not be empty",
+				"metadata: must be a JSON object",
+				"plans[0].name: must not be empty",
+				"plans[0].description: must not be empty",
+				"plans[0].composition_ref: must not be empty",
+			},
+		},
+		"no plans": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.Plans = nil
+			},
+			wantViolations: []string{"plans: a service must have at least one plan"},
+		},
+		"schemas": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.Plans[0].Schemas.Instance.Create.Parameters = map[string]interface{}{
+					"type": "string",
+					"properties": map[string]interface{}{
+						"maxmemory": map[string]interface{}{"type": "int", "minLength": float64(-1)},
+						"policy":    "allkeys-lru",
+					},
+					"required": []interface{}{"maxmemory", "maxmemory"},
+				}
+			},
+			wantViolations: []string{
+				"plans[0].schemas.service_instance.create.parameters: must declare the JSON schema version in $schema",
+				"plans[0].schemas.service_instance.create.parameters.type: parameters must be described by an object",
+				`plans[0].schemas.service_instance.create.parameters.properties.maxmemory.type: value must be one of "array", "boolean", "integer", "null", "number", "object", "string"`,
+				"plans[0].schemas.service_instance.create.parameters.properties.maxmemory.minLength: must be >= 0 but found -1",
+				"plans[0].schemas.service_instance.create.parameters.properties.policy: expected object, but got string",
+				"plans[0].schemas.service_instance.create.parameters.required: items at index 0 and 1 are equal",
+			},
+		},
+		"plan update rules": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.Plans[0].SLA = "gold"
+			},
+			config: Config{PlanUpdateSLARule: "standard>premium|premium>standard"},
+			wantViolations: []string{
+				`plans[0].sla: "gold" is not part of the plan update rules, the plan can't be updated`,
+			},
+		},
+		"plan update size rules": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.Plans[0].Name = "tiny"
+			},
+			config: Config{PlanUpdateSizeRule: "small>medium|medium>small"},
+			wantViolations: []string{
+				`plans[0].name: "tiny" is not part of the plan update rules, the plan can't be updated`,
+			},
+		},
+		"schema version": {
+			modify: func(sd *ServiceDefinitionRequest) {
+				sd.Plans[0].Schemas.Instance.Create.Parameters["$schema"] = "http://json-schema.org/draft-07/schema#"
+				sd.Plans[0].Schemas.Instance.Create.Parameters["if"] = map[string]interface{}{"required": []interface{}{}}
+				sd.Plans[0].Schemas.Instance.Create.Parameters["then"] = "required"
+			},
+			wantViolations: []string{
+				"plans[0].schemas.service_instance.create.parameters.then: expected object or boolean, but got string",
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			sd := newTestServiceDefinition()
+			tt.modify(sd)
+
+			err := validateServiceDefinition(sd, &tt.config)
+			if tt.wantViolations == nil {
+				assert.NoError(t, err)
+				return
+			}
+			require.IsType(t, &validationError{}, err)
+			assert.ElementsMatch(t, tt.wantViolations, err.(*validationError).violations)
+		})
+	}
+}
+
+func TestPlanUpdateRuleTerms(t *testing.T) {
+	assert.Equal(t, map[string]bool{"standard": true, "premium": true}, planUpdateRuleTerms("standard>premium|premium>standard"))
+}